@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+)
+
+// Environment variables holding the Azure storage credentials, so they don't appear on the command line.
+const (
+	azureConnEnv = "AZURE_STORAGE_CONNECTION_STRING"
+	azureSASEnv  = "AZURE_STORAGE_SAS_URL"
+)
+
+// meteredCheck exits 1 if the internet connection is metered, 0 if not and 3 if it can't tell.
+const meteredCheck = `try {
+$p = [Windows.Networking.Connectivity.NetworkInformation,Windows.Networking.Connectivity,ContentType=WindowsRuntime]::GetInternetConnectionProfile()
+$c = $p.GetConnectionCost()
+if ($c.NetworkCostType -eq 'Fixed' -or $c.NetworkCostType -eq 'Variable' -or $c.Roaming -or $c.OverDataLimit) { exit 1 } else { exit 0 }
+} catch { Write-Output $_.Exception.Message; exit 3 }`
+
+// metered returns true if Windows reports the internet connection as metered, such as a mobile hotspot.
+func metered() (bool, error) {
+	out, err := exec.Command(powershell, "-NoProfile", "-NonInteractive", "-Command", meteredCheck).Output()
+
+	var ee *exec.ExitError
+	switch {
+	case err == nil:
+		return false, nil
+	case errors.As(err, &ee) && ee.ExitCode() == 1:
+		return true, nil
+	}
+
+	return false, fmt.Errorf("could not check for a metered connection: %v %s", err, bytes.TrimSpace(out))
+}
+
+// azureClient returns a blob storage client using a connection string or a service SAS URL from the
+// environment.
+func azureClient() (*azblob.Client, error) {
+	if cs := os.Getenv(azureConnEnv); cs != "" {
+		return azblob.NewClientFromConnectionString(cs, nil)
+	}
+
+	if u := os.Getenv(azureSASEnv); u != "" {
+		return azblob.NewClientWithNoCredential(u, nil)
+	}
+
+	return nil, fmt.Errorf("set %s or %s to upload to Azure", azureConnEnv, azureSASEnv)
+}
+
+// azureUpload uploads the file fn as a block blob named after it into container, checking the size
+// of the uploaded blob matches fn. The local file is deleted afterwards if -azure-delete-local is set.
+// The upload is skipped on a metered connection unless -allow-metered is set, returning errMetered.
+func azureUpload(lg *log.Logger, container, fn string) error {
+	if !*metok {
+		switch m, err := metered(); {
+		case err != nil:
+			lg.Printf("Warning: %v, uploading anyway.", err)
+		case m:
+			lg.Printf("The internet connection is metered, skipping the upload to Azure and keeping %s. Use -allow-metered to upload anyway.\n", fn)
+			return errMetered
+		}
+	}
+
+	client, err := azureClient()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Base(fn)
+	lg.Printf("Uploading %s to Azure container %q as %s...\n", fn, container, name)
+
+	// Blocks are uploaded in parallel so progress may be reported from several goroutines.
+	var mu sync.Mutex
+	var pct int64
+	p := newProgress("upload", name, fi.Size())
+	opts := &azblob.UploadFileOptions{
+		BlockSize:   uploadBlock(lg, fi.Size()),
+		Concurrency: uint16(azureConc),
+		Progress: func(n int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			p.set(n)
+			if fi.Size() > 0 && n*10/fi.Size() > pct {
+				pct = n * 10 / fi.Size()
+				lg.Printf("Uploaded %d%%.\n", pct*10)
+			}
+		},
+	}
+
+	ctx := runCtx
+	if _, err := client.UploadFile(ctx, container, name, f, opts); err != nil {
+		return fmt.Errorf("error uploading to Azure: %v", err)
+	}
+	p.finish()
+
+	// Check what arrived before trusting it, in particular before deleting the local copy.
+	props, err := client.ServiceClient().NewContainerClient(container).NewBlobClient(name).GetProperties(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error checking the uploaded blob: %v", err)
+	}
+
+	if props.ContentLength == nil || *props.ContentLength != fi.Size() {
+		return errors.New("the uploaded blob is not the same size as the backup file")
+	}
+
+	lg.Printf("Uploaded to Azure blob %s/%s.\n", container, name)
+
+	if *shareurl {
+		if err := shareBlob(lg, client, container, name, fn); err != nil {
+			lg.Printf("Warning: %v", err)
+		}
+	}
+
+	if *azdelete {
+		f.Close()
+		if err := os.Remove(fn); err != nil {
+			return err
+		}
+		lg.Printf("Deleted local copy %s.\n", fn)
+	}
+
+	return nil
+}
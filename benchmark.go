@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// benchmarkFile compresses fn with every compressor, and each zstd level, in a temporary directory
+// and prints how long each took and how big the result was. Nothing is kept.
+func benchmarkFile(fn string) error {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp("", "wsl2backup-benchmark-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	type run struct {
+		name string
+		c    compressor
+	}
+
+	var runs []run
+	var names []string
+	for n := range compressors {
+		if n != "zstd" {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		runs = append(runs, run{n, compressors[n]})
+	}
+
+	for _, l := range []zstd.EncoderLevel{zstd.SpeedFastest, zstd.SpeedDefault, zstd.SpeedBetterCompression, zstd.SpeedBestCompression} {
+		l := l
+		runs = append(runs, run{"zstd " + l.String(), compressor{".zst", func(w io.Writer, name string) (io.WriteCloser, error) {
+			opts := []zstd.EOption{zstd.WithEncoderConcurrency(runtime.GOMAXPROCS(0)), zstd.WithEncoderLevel(l)}
+			if zstdDict != nil {
+				opts = append(opts, zstd.WithEncoderDict(zstdDict))
+			}
+			return zstd.NewWriter(w, opts...)
+		}}})
+	}
+
+	lg := log.New(io.Discard, "", 0)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Benchmarking %s (%d bytes):\n\n", fn, fi.Size())
+	fmt.Fprintln(tw, "COMPRESSOR\tTIME\tSIZE\tRATIO")
+	for _, r := range runs {
+		log.Printf("Compressing with %s...\n", r.name)
+		dst := filepath.Join(tmp, filepath.Base(fn)+r.c.ext)
+		start := time.Now()
+		if err := compressFile(lg, r.c, fn, dst, filepath.Base(fn), nil); err != nil {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\tfailed: %v\n", r.name, err)
+			continue
+		}
+		benchmarkRow(tw, r.name, time.Since(start), dst, fi.Size())
+		os.Remove(dst)
+	}
+
+	// NTFS compression works in place, so it gets a copy to compress.
+	log.Println("Compressing with compact...")
+	cp := filepath.Join(tmp, filepath.Base(fn))
+	if err := copyFile(fn, cp); err != nil {
+		return err
+	}
+	start := time.Now()
+	if saved, err := compactFile(lg, cp); err != nil {
+		fmt.Fprintf(tw, "compact\t-\t-\t-\tfailed: %v\n", err)
+	} else {
+		fmt.Fprintf(tw, "compact\t%s\t%d\t%.1f%%\n", time.Since(start).Round(time.Millisecond), fi.Size()-saved, ratio(fi.Size()-saved, fi.Size()))
+	}
+
+	return tw.Flush()
+}
+
+// benchmarkRow prints the time taken and size of the compressed file dst made from size bytes.
+func benchmarkRow(w io.Writer, name string, took time.Duration, dst string, size int64) {
+	fi, err := os.Stat(dst)
+	if err != nil {
+		fmt.Fprintf(w, "%s\t-\t-\t-\tfailed: %v\n", name, err)
+		return
+	}
+
+	fmt.Fprintf(w, "%s\t%s\t%d\t%.1f%%\n", name, took.Round(time.Millisecond), fi.Size(), ratio(fi.Size(), size))
+}
+
+// ratio returns n as a percentage of total.
+func ratio(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	return float64(n) * 100 / float64(total)
+}
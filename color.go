@@ -0,0 +1,37 @@
+package main
+
+import "os"
+
+// ANSI escape sequences for coloring log lines.
+const (
+	ansiRed   = "\x1b[31m"
+	ansiGreen = "\x1b[32m"
+	ansiReset = "\x1b[0m"
+)
+
+// useColor is set by initColor when log output goes to a terminal that understands ANSI colors.
+var useColor bool
+
+// initColor turns on colored log output unless -no-color or NO_COLOR is set or the log isn't a terminal.
+func initColor() {
+	if *nocolor || os.Getenv("NO_COLOR") != "" {
+		return
+	}
+
+	useColor = enableTerminalColor(os.Stderr)
+}
+
+// colorize wraps s in the ANSI color code if color is enabled.
+func colorize(code, s string) string {
+	if !useColor {
+		return s
+	}
+
+	return code + s + ansiReset
+}
+
+// green colors a success message.
+func green(s string) string { return colorize(ansiGreen, s) }
+
+// red colors a failure message.
+func red(s string) string { return colorize(ansiRed, s) }
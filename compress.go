@@ -0,0 +1,473 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4/v4"
+)
+
+// compressor is a compression format for -z.
+type compressor struct {
+	ext string
+	// newWriter returns a writer compressing into w, recording the data as name if the format has
+	// somewhere to store it.
+	newWriter func(w io.Writer, name string) (io.WriteCloser, error)
+}
+
+// compressors are the formats supported by -z.
+var compressors = map[string]compressor{
+	"zip":    {".zip", newZipWriter},
+	"gzip":   {".gz", newGzipWriter},
+	"lz4":    {".lz4", newLZ4Writer},
+	"zstd":   {".zst", newZstdWriter},
+	"brotli": {".br", newBrotliWriter},
+}
+
+// compressFlag is the value of -z. It is a boolean flag so a plain -z still means ZIP while -z=gzip
+// chooses another format.
+type compressFlag string
+
+// compressVar defines a compressFlag with the given name and usage.
+func compressVar(name, usage string) *compressFlag {
+	c := new(compressFlag)
+	flag.Var(c, name, usage)
+	return c
+}
+
+func (c *compressFlag) String() string { return string(*c) }
+
+func (c *compressFlag) IsBoolFlag() bool { return true }
+
+func (c *compressFlag) Set(s string) error {
+	switch s {
+	case "true":
+		*c = "zip"
+	case "false":
+		*c = ""
+	default:
+		if _, ok := compressors[s]; !ok {
+			return fmt.Errorf("unsupported compression %q", s)
+		}
+		*c = compressFlag(s)
+	}
+
+	return nil
+}
+
+// zipWriter writes a single file into a ZIP archive, closing the archive when the file is closed.
+type zipWriter struct {
+	io.Writer
+	zw *zip.Writer
+}
+
+func (z *zipWriter) Close() error { return z.zw.Close() }
+
+// zipMethod returns the ZIP compression method to store the file name with. With -zip-method auto,
+// vhdx files are stored uncompressed since deflate takes a long time to gain very little on them.
+func zipMethod(name string) uint16 {
+	switch {
+	case *zipmeth == "store":
+		return zip.Store
+	case *zipmeth == "auto" && strings.EqualFold(filepath.Ext(name), ".vhdx"):
+		return zip.Store
+	}
+
+	return zip.Deflate
+}
+
+func newZipWriter(w io.Writer, name string) (io.WriteCloser, error) {
+	zw := zip.NewWriter(w)
+	cw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zipMethod(name)})
+	if err != nil {
+		return nil, fmt.Errorf("error creating zip directory: %v", err)
+	}
+
+	return &zipWriter{cw, zw}, nil
+}
+
+// newGzipWriter compresses using blocks of -gzip-block KB on -gzip-blocks goroutines. The output is a
+// standard gzip file.
+func newGzipWriter(w io.Writer, name string) (io.WriteCloser, error) {
+	gw := pgzip.NewWriter(w)
+	gw.Name = name
+	if err := gw.SetConcurrency(*gzblock*1024, *gzprocs); err != nil {
+		return nil, fmt.Errorf("error setting gzip concurrency: %v", err)
+	}
+
+	return gw, nil
+}
+
+// newLZ4Writer compresses with lz4, which is much faster than ZIP or gzip at the cost of a larger
+// file. The lz4 frame format has nowhere to store name.
+func newLZ4Writer(w io.Writer, name string) (io.WriteCloser, error) {
+	lw := lz4.NewWriter(w)
+	if lz4Block != 0 {
+		if err := lw.Apply(lz4.BlockSizeOption(lz4Block)); err != nil {
+			return nil, fmt.Errorf("error setting lz4 block size: %v", err)
+		}
+	}
+
+	return lw, nil
+}
+
+// newBrotliWriter compresses with brotli at -level, which web servers and browsers can decompress by
+// themselves. It is slow, so better suited to backups that will be downloaded than to every backup.
+// The brotli format has nowhere to store name.
+func newBrotliWriter(w io.Writer, name string) (io.WriteCloser, error) {
+	return brotli.NewWriterOptions(w, brotli.WriterOptions{Quality: *level, LGWin: brotliWin}), nil
+}
+
+// uncompressedName returns fn without the extension added by compression, or fn if it is not compressed.
+func uncompressedName(fn string) string {
+	for _, c := range compressors {
+		if strings.HasSuffix(strings.ToLower(fn), c.ext) {
+			return fn[:len(fn)-len(c.ext)]
+		}
+	}
+
+	return fn
+}
+
+// ctxReader reads from r until ctx is done, so a cancelled run stops copying.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return c.r.Read(p)
+}
+
+// multiCloser closes a reader and then the file it reads from.
+type multiCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (m *multiCloser) Close() error {
+	var err error
+	for _, c := range m.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// openCompressed opens the backup stored in the compressed file fn, returning a reader of the
+// decompressed data and the name the backup was stored as.
+func openCompressed(fn string) (io.ReadCloser, string, error) {
+	name := filepath.Base(uncompressedName(fn))
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".zip":
+		zr, err := zip.OpenReader(fn)
+		if err != nil {
+			return nil, "", fmt.Errorf("error opening zip file: %v", err)
+		}
+
+		if len(zr.File) != 1 {
+			zr.Close()
+			return nil, "", fmt.Errorf("expected one backup in %s but found %d files", fn, len(zr.File))
+		}
+
+		rc, err := zr.File[0].Open()
+		if err != nil {
+			zr.Close()
+			return nil, "", err
+		}
+
+		return &multiCloser{rc, []io.Closer{rc, zr}}, zr.File[0].Name, nil
+	case ".gz":
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, "", err
+		}
+
+		gr, err := pgzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, "", fmt.Errorf("error opening gzip file: %v", err)
+		}
+
+		if gr.Name != "" {
+			name = gr.Name
+		}
+
+		return &multiCloser{gr, []io.Closer{gr, f}}, name, nil
+	case ".lz4":
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return &multiCloser{lz4.NewReader(f), []io.Closer{f}}, name, nil
+	case ".zst":
+		rc, err := openZstd(fn)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return rc, name, nil
+	case ".br":
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return &multiCloser{brotli.NewReader(f), []io.Closer{f}}, name, nil
+	}
+
+	return nil, "", fmt.Errorf("%s is not a compressed backup", fn)
+}
+
+// compressRoom returns an error if there isn't room next to dst for a compressed copy of fn, taken to
+// be as big as fn to be safe since fn is still there until compression finishes. Space may have been
+// used up since the export started.
+func compressRoom(lg *log.Logger, fn, dst string) error {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+
+	free, err := diskFree(filepath.Dir(dst))
+	if err != nil {
+		lg.Printf("Warning: could not check free disk space before compressing: %v", err)
+		return nil
+	}
+
+	if uint64(fi.Size()) > free {
+		return fmt.Errorf("not enough free disk space to compress %s: it is %d bytes but only %d bytes are free in %s", fn, fi.Size(), free, filepath.Dir(dst))
+	}
+
+	return nil
+}
+
+// compressFile compresses the file fn into dst using c, storing it in the archive under name. If sum
+// isn't nil the uncompressed data is written to it too, to checksum it in the same pass. The
+// compressed file is synced to disk before returning so fn can safely be deleted, and a partial dst
+// is removed on failure so an interrupted compression never looks like a finished one.
+func compressFile(lg *log.Logger, c compressor, fn, dst, name string, sum io.Writer) (err error) {
+	lg.Printf("Compressing %s file to %s...\n", fn, dst)
+
+	// Open the original file first so a missing source doesn't leave an empty compressed file behind.
+	uf, err := os.Open(fn)
+	if err != nil {
+		return fmt.Errorf("error opening exported file: %v", err)
+	}
+	defer uf.Close()
+
+	// Create the compressed file, truncating any left by an earlier interrupted run.
+	cf, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("error creating compressed file: %v", err)
+	}
+	defer func() {
+		cf.Close()
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+
+	w, err := c.newWriter(cf, name)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	if fi, err := uf.Stat(); err == nil {
+		total = fi.Size()
+	}
+
+	p := newProgress("compress", dst, total)
+	src := io.TeeReader(ctxReader{runCtx, uf}, p)
+	if sum != nil {
+		src = io.TeeReader(src, sum)
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		return fmt.Errorf("error compressing file: %v", err)
+	}
+	p.finish()
+
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	if err = cf.Sync(); err != nil {
+		return err
+	}
+
+	if err = cf.Close(); err != nil {
+		return err
+	}
+
+	lg.Println("Compression completed successfully.")
+
+	return nil
+}
+
+// compressExport streams a tar export of distro straight from exportCmd into dst using c as name,
+// avoiding the need for disk space to hold the uncompressed tar. The partial file is removed on
+// failure. If sum isn't nil the tar is written to it too.
+func compressExport(lg *log.Logger, c compressor, distro, dst, name string, sum io.Writer) (err error) {
+	lg.Printf("Exporting distribution %q directly to compressed file %q...\n", distro, dst)
+
+	cf, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("error creating compressed file: %v", err)
+	}
+	defer func() {
+		if cerr := cf.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+
+	w, err := c.newWriter(cf, name)
+	if err != nil {
+		return err
+	}
+
+	p := newProgress("export", dst, 0)
+	out := io.MultiWriter(w, p)
+	if sum != nil {
+		out = io.MultiWriter(w, p, sum)
+	}
+	if err := runExport(lg, exportCmd(distro), out); err != nil {
+		return err
+	}
+	p.finish()
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	lg.Println("Export and compression completed successfully.")
+
+	return nil
+}
+
+// compressOnly compresses an existing backup fn with -z or -c without exporting anything, deleting fn
+// afterwards unless -keep is set just as a backup run would.
+func compressOnly(fn string) error {
+	if _, err := os.Stat(fn); err != nil {
+		return err
+	}
+
+	if *compact {
+		saved, err := compactFile(log.Default(), fn)
+		if err != nil {
+			return fmt.Errorf("error compacting file: %v", err)
+		}
+		log.Printf("Compacted %s, saving %d bytes.\n", fn, saved)
+		return nil
+	}
+
+	c := compressors[string(*outzip)]
+	dst := fn + c.ext
+	if *zipdir != "" {
+		if err := os.MkdirAll(*zipdir, 0755); err != nil {
+			return err
+		}
+		dst = filepath.Join(*zipdir, filepath.Base(fn)+c.ext)
+	}
+
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("%s already exists, not overwriting it", dst)
+	}
+
+	work := dst
+	if !*noatom {
+		work = partialName(dst)
+	}
+
+	if err := compressRoom(log.Default(), fn, work); err != nil {
+		return err
+	}
+
+	if err := compressFile(log.Default(), c, fn, work, filepath.Base(fn), nil); err != nil {
+		return err
+	}
+
+	if err := finalize(work, dst); err != nil {
+		return err
+	}
+	log.Printf("Compressed file written to %s.\n", dst)
+
+	if !*keep {
+		if err := os.Remove(fn); err != nil {
+			return fmt.Errorf("error removing %s after compressing it: %v", fn, err)
+		}
+	}
+
+	return nil
+}
+
+// bundleFiles writes files into a single ZIP archive dst, one entry each named after the file.
+func bundleFiles(lg *log.Logger, dst string, files []string) (err error) {
+	lg.Printf("Bundling %d backups into %s...\n", len(files), dst)
+
+	cf, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("error creating bundle file: %v", err)
+	}
+	defer func() {
+		cf.Close()
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+
+	zw := zip.NewWriter(cf)
+	for _, fn := range files {
+		if err := bundleFile(zw, fn); err != nil {
+			return err
+		}
+	}
+
+	if err = zw.Close(); err != nil {
+		return err
+	}
+
+	if err = cf.Sync(); err != nil {
+		return err
+	}
+
+	return cf.Close()
+}
+
+// bundleFile adds the file fn to zw.
+func bundleFile(zw *zip.Writer, fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: filepath.Base(fn), Method: zipMethod(fn)})
+	if err != nil {
+		return fmt.Errorf("error adding %s to bundle: %v", fn, err)
+	}
+
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("error adding %s to bundle: %v", fn, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// diffEntry is what -diff-live compares of a file, in the backup or in the distribution. Only the
+// sizes of regular files are compared, tar records links with no size while find gives the length
+// of a symlink's target.
+type diffEntry struct {
+	dir, reg bool
+	size     int64
+	mtime    int64
+}
+
+// backupEntries returns the files in the tar backup fn by their path from the root of the
+// distribution.
+func backupEntries(fn string) (map[string]diffEntry, error) {
+	var rc io.ReadCloser
+	var err error
+	name := fn
+	if uncompressedName(fn) != fn {
+		rc, name, err = openCompressed(fn)
+	} else {
+		rc, err = os.Open(fn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	if !strings.EqualFold(path.Ext(name), ".tar") {
+		return nil, fmt.Errorf("%s is not a tar backup, only tar backups can be compared with the distribution", fn)
+	}
+
+	files := make(map[string]diffEntry)
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading tar: %v", err)
+		}
+
+		p := strings.Trim(strings.TrimPrefix(hdr.Name, "./"), "/")
+		if p == "" || p == "." {
+			continue
+		}
+		files[p] = diffEntry{hdr.Typeflag == tar.TypeDir, hdr.Typeflag == tar.TypeReg, hdr.Size, hdr.ModTime.Unix()}
+	}
+
+	return files, nil
+}
+
+// liveEntries returns the files in distro by their path from the root, as wsl --export would see
+// them.
+func liveEntries(distro string) (map[string]diffEntry, error) {
+	running := distroRunning(distro)
+	// File names may hold anything but NUL, so separate entries with it.
+	out, err := exec.Command(wsl, "-d", distro, "-u", "root", "--exec", "find", "/", "-xdev", "-mindepth", "1", "-printf", `%y %s %T@ %P\0`).Output()
+	if err := restoreRunState(distro, running); err != nil {
+		log.Printf("Warning: error terminating %s: %v", distro, err)
+	}
+	// find fails on files it can't read but still lists everything else.
+	if err != nil && len(out) == 0 {
+		return nil, fmt.Errorf("error listing files in %s: %v", distro, err)
+	}
+
+	files := make(map[string]diffEntry)
+	for _, rec := range bytes.Split(out, []byte{0}) {
+		f := strings.SplitN(string(rec), " ", 4)
+		if len(f) != 4 {
+			continue
+		}
+
+		size, _ := strconv.ParseInt(f[1], 10, 64)
+		secs, _, _ := strings.Cut(f[2], ".")
+		mtime, _ := strconv.ParseInt(secs, 10, 64)
+		files[f[3]] = diffEntry{f[0] == "d", f[0] == "f", size, mtime}
+	}
+
+	return files, nil
+}
+
+// diffLive prints the files added, removed and modified in distro since the tar backup fn was made.
+// Files are modified when their modification time, or the size of a regular file, differs.
+// Directories are only reported when added or removed, since their times change whenever a file in
+// them does.
+func diffLive(fn, distro string) error {
+	old, err := backupEntries(fn)
+	if err != nil {
+		return err
+	}
+
+	cur, err := liveEntries(distro)
+	if err != nil {
+		return err
+	}
+
+	var added, removed, modified []string
+	for p, c := range cur {
+		o, ok := old[p]
+		switch {
+		case !ok:
+			added = append(added, p)
+		case c.dir || o.dir:
+		case c.reg && o.reg && c.size != o.size, c.mtime != o.mtime:
+			modified = append(modified, p)
+		}
+	}
+	for p := range old {
+		if _, ok := cur[p]; !ok {
+			removed = append(removed, p)
+		}
+	}
+
+	for _, l := range []struct {
+		mark  string
+		paths []string
+	}{{"+", added}, {"-", removed}, {"M", modified}} {
+		sort.Strings(l.paths)
+		for _, p := range l.paths {
+			fmt.Printf("%s /%s\n", l.mark, p)
+		}
+	}
+
+	fmt.Printf("%d added, %d removed, %d modified in %s since %s.\n", len(added), len(removed), len(modified), distro, fn)
+
+	return nil
+}
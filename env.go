@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix is the prefix of environment variables that set flags, e.g. WSL2BACKUP_DISTRO for -distro.
+const envPrefix = "WSL2BACKUP_"
+
+// envNames are the environment variable names of the single letter flags, which would be cryptic
+// otherwise.
+var envNames = map[string]string{
+	"o": "OUTPUT",
+	"f": "FORMAT",
+	"z": "COMPRESS",
+	"s": "SHUTDOWN",
+	"c": "COMPACT",
+}
+
+// envName returns the environment variable that sets the flag name.
+func envName(name string) string {
+	if n, ok := envNames[name]; ok {
+		return envPrefix + n
+	}
+
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// flagsFromEnv sets every flag not given on the command line from its environment variable, if set.
+func flagsFromEnv() error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok || err != nil || flagSet(f.Name) {
+			return
+		}
+
+		if serr := flag.Set(f.Name, v); serr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", v, envName(f.Name), serr)
+		}
+	})
+
+	return err
+}
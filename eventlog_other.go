@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+// writeEvent is only supported on Windows where there is an event log.
+func writeEvent(r result) error {
+	return errors.New("the event log is only supported on Windows")
+}
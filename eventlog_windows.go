@@ -0,0 +1,55 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// eventSourceKey is where the event source is registered.
+const eventSourceKey = `SYSTEM\CurrentControlSet\Services\EventLog\Application\` + eventSource
+
+// registerEventSource registers the event source using EventCreate.exe's messages if it isn't
+// already, which needs an elevated prompt the first time.
+func registerEventSource() error {
+	if k, err := registry.OpenKey(registry.LOCAL_MACHINE, eventSourceKey, registry.QUERY_VALUE); err == nil {
+		k.Close()
+		return nil
+	}
+
+	return eventlog.InstallAsEventCreate(eventSource, eventlog.Error|eventlog.Warning|eventlog.Info)
+}
+
+// writeEvent writes the result r to the Application event log.
+func writeEvent(r result) error {
+	// Events are still written without the source registered, Event Viewer just shows them less nicely.
+	regErr := registerEventSource()
+
+	el, err := eventlog.Open(eventSource)
+	if err != nil {
+		return fmt.Errorf("error opening the event log: %v", err)
+	}
+	defer el.Close()
+
+	msg := resultText(r)
+	switch {
+	case r.skipped():
+		err = el.Warning(eventSkipped, msg)
+	case r.err != nil:
+		err = el.Error(eventFailure, msg)
+	default:
+		err = el.Info(eventSuccess, msg)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing to the event log: %v", err)
+	}
+
+	if regErr != nil {
+		return fmt.Errorf("error registering the %s event source, run once as administrator to register it: %v", eventSource, regErr)
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// freezeTimeout is how long fsfreeze gets to run. Starting a command in a distribution whose root
+// filesystem is frozen can block, which mustn't hang the backup.
+const freezeTimeout = 30 * time.Second
+
+// freezeCmd runs fsfreeze with op on the root filesystem of distro.
+func freezeCmd(distro, op string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), freezeTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, wsl, "-d", distro, "-u", "root", "--exec", "fsfreeze", op, "/").CombinedOutput()
+	if ctx.Err() != nil {
+		return fmt.Errorf("fsfreeze %s did not finish within %v", op, freezeTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
+
+// freezeCopy copies the virtual disk of the running distro to of while its root filesystem is frozen
+// with fsfreeze, so the copy is consistent without terminating it. The filesystem is thawed however
+// the copy ends.
+func freezeCopy(lg *log.Logger, distro, of string) error {
+	vhd, err := liveVHDX(distro)
+	if err != nil {
+		return fmt.Errorf("could not find the disk of %s to copy: %v", distro, err)
+	}
+
+	in, err := os.Open(vhd)
+	if err != nil {
+		return fmt.Errorf("error opening the disk of running distribution %s: %v", distro, err)
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(of)
+	if err != nil {
+		return err
+	}
+
+	lg.Printf("Freezing the root filesystem of running distribution %s to copy %s to %s...\n", distro, vhd, of)
+	if err := freezeCmd(distro, "-f"); err != nil {
+		out.Close()
+		// A freeze that timed out may still have happened.
+		freezeCmd(distro, "-u")
+		return fmt.Errorf("error freezing %s: %v", distro, err)
+	}
+	defer func() {
+		if err := freezeCmd(distro, "-u"); err != nil {
+			lg.Print(red(fmt.Sprintf("ERROR: could not thaw the root filesystem of %s, which is still frozen: %v. Run \"%s -d %s -u root fsfreeze -u /\" or \"%s --terminate %s\".", distro, err, wsl, distro, wsl, distro)))
+			return
+		}
+		lg.Printf("Thawed the root filesystem of %s.\n", distro)
+	}()
+
+	p := newProgress("export", of, fi.Size())
+	if _, err := io.Copy(io.MultiWriter(out, p), ctxReader{runCtx, in}); err != nil {
+		out.Close()
+		return fmt.Errorf("error copying the disk of %s: %v", distro, err)
+	}
+	p.finish()
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+	lg.Println("Copy succeeded.")
+
+	return nil
+}
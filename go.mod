@@ -2,4 +2,21 @@ module github.com/sourcekris/wsl2backup
 
 go 1.21.1
 
-require golang.org/x/text v0.13.0 // indirect
+require (
+	github.com/Azure/azure-sdk-for-go/sdk/storage/azblob v1.2.0
+	github.com/andybalholm/brotli v1.0.6
+	github.com/klauspost/compress v1.17.0
+	github.com/klauspost/pgzip v1.2.6
+	github.com/pierrec/lz4/v4 v4.1.18
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	github.com/zeebo/blake3 v0.2.3
+	golang.org/x/sys v0.13.0
+	golang.org/x/text v0.13.0
+)
+
+require (
+	github.com/Azure/azure-sdk-for-go/sdk/azcore v1.7.0 // indirect
+	github.com/Azure/azure-sdk-for-go/sdk/internal v1.3.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
+	golang.org/x/net v0.10.0 // indirect
+)
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// healthReport is what -health finds out about the WSL environment.
+type healthReport struct {
+	WSLVersion string         `json:"wsl_version,omitempty"`
+	WSLError   string         `json:"wsl_error,omitempty"`
+	Distros    []healthDistro `json:"distros"`
+	WSLConfig  string         `json:"wslconfig,omitempty"`
+	Disks      []healthDisk   `json:"disks"`
+	Tools      []healthTool   `json:"tools"`
+}
+
+type healthDistro struct {
+	Name    string `json:"name"`
+	State   string `json:"state"`
+	Version string `json:"version"`
+	Default bool   `json:"default"`
+}
+
+type healthDisk struct {
+	Path  string `json:"path"`
+	Free  uint64 `json:"free_bytes"`
+	Error string `json:"error,omitempty"`
+}
+
+type healthTool struct {
+	Name string `json:"name"`
+	Path string `json:"path,omitempty"`
+}
+
+// checkHealth gathers everything relevant to backing up WSL on this machine.
+func checkHealth() healthReport {
+	var h healthReport
+	if v, err := wslVersion(); err != nil {
+		h.WSLError = err.Error()
+	} else {
+		h.WSLVersion = v
+	}
+
+	if distros, err := listDistros(); err != nil && h.WSLError == "" {
+		h.WSLError = err.Error()
+	} else {
+		for _, d := range distros {
+			h.Distros = append(h.Distros, healthDistro{d.name, d.state, d.version, d.isDefault})
+		}
+	}
+
+	if fn, err := wslConfigPath(); err == nil {
+		if _, err := os.Stat(fn); err == nil {
+			h.WSLConfig = fn
+		}
+	}
+
+	dirs := []string{backupDir()}
+	if *zipdir != "" {
+		dirs = append(dirs, *zipdir)
+	}
+	if tmp := os.TempDir(); filepath.VolumeName(tmp) != filepath.VolumeName(backupDir()) {
+		dirs = append(dirs, tmp)
+	}
+	for _, d := range dirs {
+		disk := healthDisk{Path: d}
+		free, err := diskFree(d)
+		if err != nil {
+			disk.Error = err.Error()
+		}
+		disk.Free = free
+		h.Disks = append(h.Disks, disk)
+	}
+
+	for _, t := range []string{wsl, compactexe, powershell} {
+		p, _ := exec.LookPath(t)
+		h.Tools = append(h.Tools, healthTool{t, p})
+	}
+
+	return h
+}
+
+// printHealth prints h for a human, or as JSON.
+func printHealth(h healthReport, asJSON bool) error {
+	if asJSON {
+		b, err := json.MarshalIndent(&h, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Printf("%s\n", b)
+		return err
+	}
+
+	if h.WSLError != "" {
+		fmt.Printf("WSL:        error: %s\n", h.WSLError)
+	} else {
+		fmt.Printf("WSL:        %s\n", h.WSLVersion)
+	}
+
+	fmt.Printf("Distributions:\n")
+	for _, d := range h.Distros {
+		def := ""
+		if d.Default {
+			def = " (default)"
+		}
+		fmt.Printf("  %s: %s, WSL %s%s\n", d.Name, d.State, d.Version, def)
+	}
+
+	if h.WSLConfig != "" {
+		fmt.Printf(".wslconfig: %s\n", h.WSLConfig)
+	} else {
+		fmt.Printf(".wslconfig: none\n")
+	}
+
+	fmt.Printf("Free disk space:\n")
+	for _, d := range h.Disks {
+		if d.Error != "" {
+			fmt.Printf("  %s: error: %s\n", d.Path, d.Error)
+			continue
+		}
+		fmt.Printf("  %s: %d bytes\n", d.Path, d.Free)
+	}
+
+	fmt.Printf("Tools:\n")
+	for _, t := range h.Tools {
+		if t.Path == "" {
+			fmt.Printf("  %s: not found\n", t.Name)
+			continue
+		}
+		fmt.Printf("  %s: %s\n", t.Name, t.Path)
+	}
+
+	return nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/encoding/unicode"
+)
+
+const (
+	// VHDX layout, see the [MS-VHDX] specification.
+	vhdxSignature     = "vhdxfile"
+	vhdxHeaderSig     = "head"
+	vhdxRegionSig     = "regi"
+	vhdxMetadataSig   = "metadata"
+	vhdxHeader1Offset = 64 * 1024
+	vhdxHeader2Offset = 128 * 1024
+	vhdxRegionOffset  = 192 * 1024
+	vhdxHeaderSize    = 4 * 1024
+	vhdxRegionSize    = 64 * 1024
+	vhdxMetadataMax   = 32 * 1024 * 1024
+
+	// Region and metadata item GUIDs.
+	vhdxMetadataRegion = "8B7CA206-4790-4B9A-B8FE-575F050F886E"
+	vhdxVirtualSize    = "2FA54224-CD1B-4876-B211-5DBED83BF4B8"
+	vhdxLogicalSector  = "8141BF1D-A96F-4709-BA47-F233A8FAAB5F"
+	vhdxFileParameters = "CAA16737-FA36-4D43-B3B6-33F0AA44E76B"
+)
+
+// inspectFile prints a summary of the contents of a backup file without restoring it. Tar and ZIP
+// archives have their top level contents listed and vhdx files have their header metadata printed.
+func inspectFile(fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("File:     %s\n", fn)
+	fmt.Printf("Size:     %d bytes\n", fi.Size())
+	fmt.Printf("Modified: %s\n", fi.ModTime().Format("2006-01-02 15:04:05"))
+
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".zip":
+		return inspectZip(f, fi.Size())
+	case ".gz":
+		return inspectCompressed(fn, "gzip")
+	case ".lz4":
+		return inspectCompressed(fn, "lz4")
+	case ".zst":
+		return inspectCompressed(fn, "zstd")
+	case ".br":
+		return inspectCompressed(fn, "brotli")
+	case ".tar":
+		return inspectTar(f)
+	case ".vhdx":
+		return inspectVHDX(f)
+	}
+
+	return fmt.Errorf("do not know how to inspect %s, supported types are .tar, .vhdx, .zip, .gz, .lz4, .zst and .br", fn)
+}
+
+// inspectCompressed prints the name of the file in a gzip, lz4, zstd or brotli file, listing it if it
+// is a tar.
+func inspectCompressed(fn, kind string) error {
+	rc, name, err := openCompressed(fn)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	fmt.Printf("Type:     %s file\n", kind)
+	fmt.Printf("Stored:   %s\n", name)
+	if strings.ToLower(filepath.Ext(name)) != ".tar" {
+		return nil
+	}
+
+	fmt.Printf("\nContents of %s:\n", name)
+	return inspectTar(rc)
+}
+
+// inspectZip lists the entries in a ZIP file. A tar inside the ZIP is also listed since that is how
+// compressed tar backups are stored.
+func inspectZip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("error reading zip file: %v", err)
+	}
+
+	fmt.Printf("Type:     ZIP archive\n")
+	fmt.Printf("Entries:  %d\n", len(zr.File))
+	for _, zf := range zr.File {
+		fmt.Printf("  %s (%d bytes, %d compressed)\n", zf.Name, zf.UncompressedSize64, zf.CompressedSize64)
+	}
+
+	for _, zf := range zr.File {
+		if strings.ToLower(filepath.Ext(zf.Name)) != ".tar" {
+			continue
+		}
+
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\nContents of %s:\n", zf.Name)
+		err = inspectTar(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inspectTar reads through a tar stream and prints the top level entries and total entry count.
+func inspectTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	top := make(map[string]bool)
+	var count int
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading tar: %v", err)
+		}
+
+		count++
+		name := strings.TrimPrefix(strings.TrimPrefix(hdr.Name, "./"), "/")
+		if first, _, _ := strings.Cut(name, "/"); first != "" {
+			top[first] = true
+		}
+	}
+
+	var names []string
+	for n := range top {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	fmt.Printf("Type:     tar archive\n")
+	fmt.Printf("Entries:  %d\n", count)
+	fmt.Printf("Contents: %s\n", strings.Join(names, " "))
+
+	return nil
+}
+
+// vhdxGUID converts a GUID string into its on disk form, where the first three groups are little endian.
+func vhdxGUID(s string) []byte {
+	b, _ := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	for _, g := range [][2]int{{0, 4}, {4, 6}, {6, 8}} {
+		for i, j := g[0], g[1]-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+	}
+
+	return b
+}
+
+// vhdxStruct reads a VHDX structure of size bytes at off, checking its signature and CRC-32C checksum
+// which is stored at offset 4 and calculated with the checksum field zeroed.
+func vhdxStruct(r io.ReaderAt, off int64, size int, sig string) ([]byte, error) {
+	buf := make([]byte, size)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+
+	if string(buf[:4]) != sig {
+		return nil, fmt.Errorf("no %q signature at offset %d", sig, off)
+	}
+
+	sum := binary.LittleEndian.Uint32(buf[4:8])
+	chk := append([]byte(nil), buf...)
+	copy(chk[4:8], []byte{0, 0, 0, 0})
+	if crc32.Checksum(chk, crc32.MakeTable(crc32.Castagnoli)) != sum {
+		return nil, fmt.Errorf("bad %q checksum at offset %d", sig, off)
+	}
+
+	return buf, nil
+}
+
+// inspectVHDX prints the file identifier, active header and virtual disk metadata of a vhdx file.
+// VHDX has no creation time field so the file modification time printed above is the best we have.
+func inspectVHDX(r io.ReaderAt) error {
+	ident := make([]byte, 8+512)
+	if _, err := r.ReadAt(ident, 0); err != nil {
+		return fmt.Errorf("error reading vhdx identifier: %v", err)
+	}
+
+	if string(ident[:8]) != vhdxSignature {
+		return errors.New("file does not have a vhdx signature, it may be corrupt")
+	}
+
+	creator, _ := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewDecoder().Bytes(ident[8:])
+	fmt.Printf("Type:     VHDX virtual disk\n")
+	fmt.Printf("Creator:  %s\n", strings.TrimRight(string(creator), "\x00"))
+
+	// There are two headers, the current one has the highest sequence number.
+	var hdr []byte
+	var seq uint64
+	for _, off := range []int64{vhdxHeader1Offset, vhdxHeader2Offset} {
+		h, err := vhdxStruct(r, off, vhdxHeaderSize, vhdxHeaderSig)
+		if err != nil {
+			continue
+		}
+
+		if s := binary.LittleEndian.Uint64(h[8:16]); hdr == nil || s > seq {
+			hdr, seq = h, s
+		}
+	}
+
+	if hdr == nil {
+		return errors.New("no valid vhdx header found, the file may be corrupt")
+	}
+
+	fmt.Printf("Sequence: %d\n", seq)
+	fmt.Printf("Version:  %d (log version %d)\n", binary.LittleEndian.Uint16(hdr[66:68]), binary.LittleEndian.Uint16(hdr[64:66]))
+	if !bytes.Equal(hdr[48:64], make([]byte, 16)) {
+		fmt.Printf("Log:      not empty, the disk was not cleanly closed\n")
+	}
+
+	// Find the metadata region in the region table.
+	regions, err := vhdxStruct(r, vhdxRegionOffset, vhdxRegionSize, vhdxRegionSig)
+	if err != nil {
+		return err
+	}
+
+	var mdOff int64 = -1
+	var mdLen uint32
+	n := binary.LittleEndian.Uint32(regions[8:12])
+	for i := uint32(0); i < n && 16+(i+1)*32 <= vhdxRegionSize; i++ {
+		e := regions[16+i*32 : 16+(i+1)*32]
+		if bytes.Equal(e[:16], vhdxGUID(vhdxMetadataRegion)) {
+			mdOff, mdLen = int64(binary.LittleEndian.Uint64(e[16:24])), binary.LittleEndian.Uint32(e[24:28])
+		}
+	}
+
+	if mdOff < 0 {
+		return errors.New("no metadata region found in vhdx region table")
+	}
+
+	// The item offsets are from the start of the region and at least 64 KB into it, so read all of it.
+	if mdLen < 32 || mdLen > vhdxMetadataMax {
+		return fmt.Errorf("bad vhdx metadata region length %d", mdLen)
+	}
+
+	md := make([]byte, mdLen)
+	if _, err := r.ReadAt(md, mdOff); err != nil {
+		return fmt.Errorf("error reading vhdx metadata: %v", err)
+	}
+
+	if string(md[:8]) != vhdxMetadataSig {
+		return errors.New("bad vhdx metadata signature")
+	}
+
+	items := binary.LittleEndian.Uint16(md[10:12])
+	for i := 0; i < int(items) && 32+(i+1)*32 <= len(md); i++ {
+		e := md[32+i*32 : 32+(i+1)*32]
+		off := binary.LittleEndian.Uint32(e[16:20])
+		if int(off)+8 > len(md) {
+			continue
+		}
+
+		v := md[off:]
+		switch {
+		case bytes.Equal(e[:16], vhdxGUID(vhdxVirtualSize)):
+			fmt.Printf("Disk:     %d bytes\n", binary.LittleEndian.Uint64(v[:8]))
+		case bytes.Equal(e[:16], vhdxGUID(vhdxLogicalSector)):
+			fmt.Printf("Sector:   %d bytes\n", binary.LittleEndian.Uint32(v[:4]))
+		case bytes.Equal(e[:16], vhdxGUID(vhdxFileParameters)):
+			kind := "dynamic"
+			if binary.LittleEndian.Uint32(v[4:8])&1 != 0 {
+				kind = "fixed"
+			}
+			fmt.Printf("Block:    %d bytes (%s)\n", binary.LittleEndian.Uint32(v[:4]), kind)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// lockPoll is how often -detect-locked-files checks whether the disk has been released.
+const lockPoll = 2 * time.Second
+
+// liveVHDX returns the virtual disk WSL runs distro from, which is -vhd-path if given and otherwise
+// found from its registry settings.
+func liveVHDX(distro string) (string, error) {
+	if *vhdpath != "" {
+		return *vhdpath, nil
+	}
+
+	vals, err := distroSettings(distro)
+	if err != nil {
+		return "", err
+	}
+
+	base, _ := vals["BasePath"].Value.(string)
+	if base == "" {
+		return "", fmt.Errorf("no BasePath registered for %s", distro)
+	}
+
+	name := "ext4.vhdx"
+	if n, _ := vals["VhdFileName"].Value.(string); n != "" {
+		name = n
+	}
+
+	return filepath.Join(strings.TrimPrefix(base, `\\?\`), name), nil
+}
+
+// waitUnlocked waits up to -lock-wait for no other process to have the disk of distro open, so the
+// export doesn't fail with an opaque "file in use" error. The processes holding it are named.
+func waitUnlocked(lg *log.Logger, distro string) error {
+	vhd, err := liveVHDX(distro)
+	if err != nil {
+		lg.Printf("Warning: could not find the disk of %s to check it is not locked: %v", distro, err)
+		return nil
+	}
+
+	deadline := time.Now().Add(*lockwait)
+	for {
+		err := openExclusive(vhd)
+		if err == nil {
+			return nil
+		}
+
+		who := "another process"
+		if holders, herr := lockHolders(vhd); herr != nil {
+			lg.Printf("Warning: could not find which process holds %s: %v", vhd, herr)
+		} else if len(holders) > 0 {
+			who = strings.Join(holders, ", ")
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the disk of %s, %s, is still held by %s: %v", distro, vhd, who, err)
+		}
+
+		lg.Printf("The disk of %s is held by %s, waiting for it to be released...\n", distro, who)
+		time.Sleep(lockPoll)
+	}
+}
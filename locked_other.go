@@ -0,0 +1,21 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// openExclusive returns an error if fn can't be opened for writing. Files aren't locked against
+// each other here, so this only catches missing files and permissions.
+func openExclusive(fn string) error {
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// lockHolders is only supported on Windows where the Restart Manager tracks open files.
+func lockHolders(fn string) ([]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,91 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	rstrtmgr                = windows.NewLazySystemDLL("rstrtmgr.dll")
+	procRmStartSession      = rstrtmgr.NewProc("RmStartSession")
+	procRmRegisterResources = rstrtmgr.NewProc("RmRegisterResources")
+	procRmGetList           = rstrtmgr.NewProc("RmGetList")
+	procRmEndSession        = rstrtmgr.NewProc("RmEndSession")
+)
+
+// rmProcessInfo is the RM_PROCESS_INFO structure returned by RmGetList.
+type rmProcessInfo struct {
+	pid         uint32
+	startTime   windows.Filetime
+	appName     [256]uint16
+	serviceName [64]uint16
+	appType     uint32
+	appStatus   uint32
+	sessionID   uint32
+	restartable int32
+}
+
+// openExclusive opens fn with no sharing, which fails if any other process has it open.
+func openExclusive(fn string) error {
+	p, err := windows.UTF16PtrFromString(fn)
+	if err != nil {
+		return err
+	}
+
+	h, err := windows.CreateFile(p, windows.GENERIC_READ, 0, nil, windows.OPEN_EXISTING, windows.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return err
+	}
+
+	return windows.CloseHandle(h)
+}
+
+// lockHolders asks the Restart Manager which processes have fn open, returned as "name (PID n)".
+func lockHolders(fn string) ([]string, error) {
+	if err := rstrtmgr.Load(); err != nil {
+		return nil, err
+	}
+
+	var session uint32
+	var key [33]uint16
+	if r, _, _ := procRmStartSession.Call(uintptr(unsafe.Pointer(&session)), 0, uintptr(unsafe.Pointer(&key[0]))); r != 0 {
+		return nil, fmt.Errorf("RmStartSession: %v", syscall.Errno(r))
+	}
+	defer procRmEndSession.Call(uintptr(session))
+
+	p, err := windows.UTF16PtrFromString(fn)
+	if err != nil {
+		return nil, err
+	}
+	files := []*uint16{p}
+	if r, _, _ := procRmRegisterResources.Call(uintptr(session), 1, uintptr(unsafe.Pointer(&files[0])), 0, 0, 0, 0); r != 0 {
+		return nil, fmt.Errorf("RmRegisterResources: %v", syscall.Errno(r))
+	}
+
+	// Ask again with a bigger buffer while processes keep opening the file.
+	infos := make([]rmProcessInfo, 4)
+	for {
+		var needed, reasons uint32
+		n := uint32(len(infos))
+		r, _, _ := procRmGetList.Call(uintptr(session), uintptr(unsafe.Pointer(&needed)), uintptr(unsafe.Pointer(&n)),
+			uintptr(unsafe.Pointer(&infos[0])), uintptr(unsafe.Pointer(&reasons)))
+		if syscall.Errno(r) == windows.ERROR_MORE_DATA {
+			infos = make([]rmProcessInfo, needed)
+			continue
+		}
+		if r != 0 {
+			return nil, fmt.Errorf("RmGetList: %v", syscall.Errno(r))
+		}
+
+		var holders []string
+		for _, pi := range infos[:n] {
+			holders = append(holders, fmt.Sprintf("%s (PID %d)", windows.UTF16ToString(pi.appName[:]), pi.pid))
+		}
+		return holders, nil
+	}
+}
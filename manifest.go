@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zeebo/blake3"
+)
+
+// checksumAlgos are the digests supported by -checksum-algo, along with the extension of their
+// checksum file.
+var checksumAlgos = map[string]struct {
+	ext string
+	new func() hash.Hash
+}{
+	"sha256": {".sha256", sha256.New},
+	"sha512": {".sha512", sha512.New},
+	"blake3": {".b3", func() hash.Hash { return blake3.New() }},
+}
+
+// backupManifest describes a backup so its integrity can be checked long after it was made.
+type backupManifest struct {
+	RunID  string    `json:"run_id"`
+	Distro string    `json:"distro"`
+	Time   time.Time `json:"time"`
+	Format string    `json:"format"`
+	File   string    `json:"file"`
+	Size   int64     `json:"size"`
+	Algo   string    `json:"checksum_algo"`
+	// WSLVersion is the version of WSL that made the backup, if it could be found.
+	WSLVersion string `json:"wsl_version,omitempty"`
+	// ZstdDict is the -zstd-dict dictionary needed to decompress a zstd backup.
+	ZstdDict   string `json:"zstd_dict,omitempty"`
+	ZstdDictID uint32 `json:"zstd_dict_id,omitempty"`
+	// CompactSaved is the disk space in bytes saved by compacting the backup with -c.
+	CompactSaved int64 `json:"compact_saved,omitempty"`
+	// Artifact and Content are written as artifact_<algo> and content_<algo> by MarshalJSON. Content is
+	// the checksum of the export itself, which for a compressed backup is what comes out of it when
+	// decompressed.
+	Artifact string `json:"-"`
+	Content  string `json:"-"`
+}
+
+// MarshalJSON names the checksums after the algorithm used, e.g. "artifact_sha256".
+func (m backupManifest) MarshalJSON() ([]byte, error) {
+	type plain backupManifest
+	b, err := json.Marshal(plain(m))
+	if err != nil {
+		return nil, err
+	}
+
+	sums, err := json.Marshal(map[string]string{"artifact_" + m.Algo: m.Artifact})
+	if err != nil {
+		return nil, err
+	}
+	content, err := json.Marshal(map[string]string{"content_" + m.Algo: m.Content})
+	if err != nil {
+		return nil, err
+	}
+
+	// Splice the checksums onto the end of the object, keeping artifact before content.
+	b = append(bytes.TrimSuffix(b, []byte("}")), ',')
+	b = append(b, sums[1:len(sums)-1]...)
+	b = append(b, ',')
+	return append(b, content[1:]...), nil
+}
+
+// readManifest reads the manifest written by -manifest alongside the backup file fn. The manifest of
+// a backup compressed into -compressed-dir is there, so it is looked for there too.
+func readManifest(fn string) (backupManifest, error) {
+	var m backupManifest
+	mf := uncompressedName(fn) + ".manifest.json"
+	b, err := os.ReadFile(mf)
+	if errors.Is(err, fs.ErrNotExist) && *zipdir != "" {
+		b, err = os.ReadFile(filepath.Join(*zipdir, filepath.Base(mf)))
+	}
+	if err != nil {
+		return m, err
+	}
+
+	return m, json.Unmarshal(b, &m)
+}
+
+// verifyManifest checks the backup described by the manifest mf, which is looked for next to it, has
+// the size, format and checksum the manifest records, printing PASS or FAIL with what is wrong.
+func verifyManifest(mf string) error {
+	m, fn, problems, err := checkManifest(mf)
+	if err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		fmt.Printf("%s %s\n", red("FAIL"), fn)
+		for _, p := range problems {
+			fmt.Printf("  %s\n", p)
+		}
+		return fmt.Errorf("%s does not match its manifest", fn)
+	}
+
+	fmt.Printf("%s %s (%d bytes, %s %s)\n", green("PASS"), fn, m.Size, m.Algo, m.Artifact)
+	return nil
+}
+
+// checkManifest reads the manifest mf and returns it, the backup file it describes and how that file
+// differs from it, if at all.
+func checkManifest(mf string) (backupManifest, string, []string, error) {
+	var m backupManifest
+	b, err := os.ReadFile(mf)
+	if err != nil {
+		return m, "", nil, err
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, "", nil, fmt.Errorf("error reading manifest %s: %v", mf, err)
+	}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return m, "", nil, fmt.Errorf("error reading manifest %s: %v", mf, err)
+	}
+
+	m.Artifact, _ = fields["artifact_"+m.Algo].(string)
+	if _, ok := checksumAlgos[m.Algo]; !ok || m.Artifact == "" {
+		return m, "", nil, fmt.Errorf("manifest %s has no checksum of the backup", mf)
+	}
+
+	// Manifests written before they were moved next to a backup in -compressed-dir are in -dir.
+	fn := filepath.Join(filepath.Dir(mf), filepath.Base(m.File))
+	if _, err := os.Stat(fn); errors.Is(err, fs.ErrNotExist) && *zipdir != "" {
+		fn = filepath.Join(*zipdir, filepath.Base(m.File))
+	}
+	var problems []string
+	if fi, err := os.Stat(fn); err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		if fi.Size() != m.Size {
+			problems = append(problems, fmt.Sprintf("size is %d bytes but the manifest records %d", fi.Size(), m.Size))
+		}
+
+		if bn, ok := parseBackupName(fn); ok && bn.format != m.Format {
+			problems = append(problems, fmt.Sprintf("format is %s but the manifest records %s", bn.format, m.Format))
+		}
+
+		switch sum, err := checksumFile(m.Algo, fn); {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("error checksumming: %v", err))
+		case sum != m.Artifact:
+			problems = append(problems, fmt.Sprintf("%s is %s but the manifest records %s", m.Algo, sum, m.Artifact))
+		}
+	}
+
+	return m, fn, problems, nil
+}
+
+// checksumReader returns the hex checksum using algo of everything read from r.
+func checksumReader(algo string, r io.Reader) (string, error) {
+	h := checksumAlgos[algo].new()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checksumFile returns the hex checksum using algo of the file fn.
+func checksumFile(algo, fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return checksumReader(algo, f)
+}
+
+// writeChecksum writes the checksum of fn using algo next to it in the format of sha256sum and
+// similar tools, listing it as name, and returns the name of the checksum file.
+func writeChecksum(algo, fn, name string) (string, error) {
+	sum, err := checksumFile(algo, fn)
+	if err != nil {
+		return "", fmt.Errorf("error checksumming %s: %v", fn, err)
+	}
+
+	cf := fn + checksumAlgos[algo].ext
+	return cf, os.WriteFile(cf, []byte(fmt.Sprintf("%s  %s\n", sum, filepath.Base(name))), 0644)
+}
+
+// writeManifest writes the manifest of the backup file fn of distro, which will be named name, to mf,
+// using algo for the checksums. When fn is compressed it is decompressed to checksum the content,
+// which also proves the compressed file can be read back, unless the content checksum was already
+// worked out while compressing and is given as content. saved is the space saved by -c.
+func writeManifest(distro, format, algo, fn, name, mf, content string, saved int64) error {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+
+	m := backupManifest{
+		RunID:  runID,
+		Distro: distro,
+		Time:   runStart,
+		Format: format,
+		File:   filepath.Base(name),
+		Size:   fi.Size(),
+		Algo:   algo,
+
+		CompactSaved: saved,
+	}
+
+	if m.Artifact, err = checksumFile(algo, fn); err != nil {
+		return fmt.Errorf("error checksumming %s: %v", fn, err)
+	}
+
+	// Old WSL releases can't report their version, the manifest is still useful without it.
+	m.WSLVersion, _ = wslVersion()
+
+	if zstdDict != nil && strings.EqualFold(filepath.Ext(fn), ".zst") {
+		m.ZstdDict, m.ZstdDictID = *zstdict, zstdDictID(zstdDict)
+	}
+
+	m.Content = m.Artifact
+	if content != "" {
+		m.Content = content
+	} else if uncompressedName(fn) != fn {
+		rc, _, err := openCompressed(fn)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		if m.Content, err = checksumReader(algo, rc); err != nil {
+			return fmt.Errorf("error checksumming the content of %s: %v", fn, err)
+		}
+	}
+
+	b, err := json.MarshalIndent(&m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(mf, b, 0644)
+}
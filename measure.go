@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// measureExport exports distro to a temporary file in the backup directory, reports how big it is and
+// how long it took, and deletes it again. The file is removed even if the export is interrupted.
+func measureExport(distro string) error {
+	ok, err := distroCheck(log.Default(), distro)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("distro %q not found in WSL, check installed distribution with \"%s %s\"", distro, wsl, wslList)
+	}
+
+	f, err := os.CreateTemp(backupDir(), "wsl2backup-measure-*."+*outfmt)
+	if err != nil {
+		return err
+	}
+	fn := f.Name()
+	f.Close()
+	defer os.Remove(fn)
+
+	// Kill the export on Ctrl+C instead of dying, so the file above is still removed.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+	go func() {
+		<-sig
+		log.Println("Interrupted, stopping the export and removing it.")
+		cancelRun()
+	}()
+
+	start := time.Now()
+	if distroTar() {
+		err = tarExport(log.Default(), distro, fn)
+	} else {
+		err = wslExport(log.Default(), distro, *outfmt, fn)
+	}
+	if distroTar() {
+		if _, err := wslCmd("--terminate " + distro); err != nil {
+			log.Printf("Warning: error terminating %s: %v", distro, err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	took := time.Since(start)
+
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("A %s export of %s takes %v and is %d bytes (%s).\n", *outfmt, distro, took.Round(time.Second), fi.Size(), humanBytes(fi.Size()))
+	return nil
+}
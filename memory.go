@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+const (
+	// The smallest buffers -mem-limit will choose. Below these compression suffers badly.
+	minGzipBlock  = 64 << 10
+	minZstdWindow = 256 << 10
+	// The default zstd window, which -mem-limit never raises.
+	maxZstdWindow = 8 << 20
+	// The smallest and default brotli windows, as powers of two.
+	minBrotliWin = 16
+	maxBrotliWin = 22
+	// azureDefaultConc is the number of blocks the Azure SDK uploads at once by default.
+	azureDefaultConc = 5
+	// azureMaxBlocks is the most blocks a block blob may have.
+	azureMaxBlocks = 50000
+)
+
+// Buffer sizes chosen by -mem-limit. Zero leaves the library default.
+var (
+	zstdWindow, zstdConc int
+	lz4Block             lz4.BlockSize
+	brotliWin            int
+	azureBlock           int64
+	azureConc            int
+)
+
+// limitMemory sizes the buffers used while compressing and uploading so a backup needs roughly no
+// more than limit bytes. Backups run at once with -parallel share the limit. Compressing and
+// uploading happen one after the other, so each may use all of it.
+func limitMemory(limit int64) {
+	budget := limit / int64(*parallel)
+
+	// pgzip holds an input and output buffer for each block being compressed.
+	block, blocks := int64(*gzblock)*1024, int64(*gzprocs)
+	if block*blocks*2 > budget {
+		block = budget / (blocks * 2)
+		if block < minGzipBlock {
+			block = minGzipBlock
+			blocks = max(1, budget/(block*2))
+		}
+		*gzblock, *gzprocs = int(block/1024), int(blocks)
+	}
+
+	// Each zstd encoder holds about three windows of history and input.
+	window, conc := int64(maxZstdWindow), int64(runtime.GOMAXPROCS(0))
+	for window*conc*3 > budget && window > minZstdWindow {
+		window /= 2
+	}
+	for window*conc*3 > budget && conc > 1 {
+		conc--
+	}
+	zstdWindow, zstdConc = int(window), int(conc)
+
+	// lz4 compresses a block at a time, holding it and its compressed copy.
+	lz4Block = lz4.Block64Kb
+	for _, b := range []lz4.BlockSize{lz4.Block4Mb, lz4.Block1Mb, lz4.Block256Kb} {
+		if int64(b)*2 <= budget {
+			lz4Block = b
+			break
+		}
+	}
+
+	// brotli holds several copies of its window while it searches for matches.
+	brotliWin = maxBrotliWin
+	for int64(4)<<brotliWin > budget && brotliWin > minBrotliWin {
+		brotliWin--
+	}
+
+	azureConc = azureDefaultConc
+	azureBlock = budget / int64(azureConc)
+
+	var sizes []string
+	switch *outzip {
+	case "gzip":
+		sizes = append(sizes, fmt.Sprintf("gzip %d blocks of %s", *gzprocs, humanBytes(int64(*gzblock)*1024)))
+	case "zstd":
+		sizes = append(sizes, fmt.Sprintf("zstd %d encoders with %s windows", zstdConc, humanBytes(int64(zstdWindow))))
+	case "lz4":
+		sizes = append(sizes, fmt.Sprintf("lz4 %s blocks", humanBytes(int64(lz4Block))))
+	case "brotli":
+		sizes = append(sizes, fmt.Sprintf("brotli %s window", humanBytes(int64(1)<<brotliWin)))
+	}
+	if *azure != "" {
+		sizes = append(sizes, fmt.Sprintf("Azure %d uploads of %s blocks", azureConc, humanBytes(azureBlock)))
+	}
+	if len(sizes) > 0 {
+		log.Printf("Memory limited to %s per backup: %s.\n", humanBytes(budget), strings.Join(sizes, ", "))
+	}
+}
+
+// uploadBlock returns the block size to upload a blob of size bytes in, which is -mem-limit's choice
+// unless the blob would need more blocks than Azure allows.
+func uploadBlock(lg *log.Logger, size int64) int64 {
+	if azureBlock == 0 {
+		return 0
+	}
+
+	if need := (size + azureMaxBlocks - 1) / azureMaxBlocks; need > azureBlock {
+		lg.Printf("Warning: uploading in %s blocks, more than -mem-limit allows, as Azure allows at most %d blocks per blob.\n", humanBytes(need), azureMaxBlocks)
+		return need
+	}
+
+	return azureBlock
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// metricHelp is the help text of each metric written to -metrics-file, in the order they are written.
+var metricHelp = []struct{ name, help string }{
+	{"wsl2backup_success", "Whether the last backup of the distribution succeeded."},
+	{"wsl2backup_size_bytes", "Size of the last successful backup of the distribution."},
+	{"wsl2backup_duration_seconds", "How long the last backup of the distribution took."},
+	{"wsl2backup_last_run_timestamp", "Unix time of the last backup run of the distribution."},
+}
+
+// metricRE matches a sample written by writeMetrics.
+var metricRE = regexp.MustCompile(`^(wsl2backup_\w+)\{distro="((?:[^"\\]|\\.)*)"\} (\S+)$`)
+
+// metricLabel escapes a distribution name for use as a label value.
+var metricLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetrics updates the Prometheus text format file fn with results. Samples of distributions not
+// in results are kept so every distribution backed up to the same file shows up in it.
+func writeMetrics(fn string, results []result) error {
+	// metric name -> escaped distro -> value.
+	samples := make(map[string]map[string]string)
+	for _, m := range metricHelp {
+		samples[m.name] = make(map[string]string)
+	}
+
+	old, err := os.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	sc := bufio.NewScanner(bytes.NewReader(old))
+	for sc.Scan() {
+		if m := metricRE.FindStringSubmatch(sc.Text()); m != nil && samples[m[1]] != nil {
+			samples[m[1]][m[2]] = m[3]
+		}
+	}
+
+	for _, r := range results {
+		if r.skipped() {
+			continue
+		}
+
+		d := metricLabel.Replace(r.distro)
+		samples["wsl2backup_success"][d] = "0"
+		if r.err == nil {
+			samples["wsl2backup_success"][d] = "1"
+			samples["wsl2backup_size_bytes"][d] = fmt.Sprint(r.size)
+		}
+		samples["wsl2backup_duration_seconds"][d] = fmt.Sprint(r.duration.Seconds())
+		samples["wsl2backup_last_run_timestamp"][d] = fmt.Sprint(runStart.Unix())
+	}
+
+	var b bytes.Buffer
+	for _, m := range metricHelp {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+
+		var distros []string
+		for d := range samples[m.name] {
+			distros = append(distros, d)
+		}
+		sort.Strings(distros)
+
+		for _, d := range distros {
+			fmt.Fprintf(&b, "%s{distro=\"%s\"} %s\n", m.name, d, samples[m.name][d])
+		}
+	}
+
+	return writeAtomic(fn, b.Bytes())
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stage is one step of backing up a distribution. A stage whose flags aren't set does nothing.
+type stage struct {
+	name string
+	run  func(j *backupJob) error
+	// always is set for a stage that runs even after an earlier one failed or completed the backup.
+	always bool
+}
+
+// backupStages are the stages of a backup in the order they run. The first to fail stops the backup,
+// except that post-hook always runs. Stages that depend on each other must stay in this order:
+//
+//   - check leaves a distribution with -stop-services running for pre-hook to stop them, and
+//     pre-hook then terminates it.
+//   - post-hook starts the services again as soon as the export has been made and validated, rather
+//     than keeping them down while it is compressed and uploaded.
+//   - checksum runs before verify moves the backup into place, so nothing is renamed until the
+//     export, compression and checksums have all succeeded.
+//   - prune only runs once the backup is uploaded, so the only copy of a backup is never deleted.
+//
+// The notification is sent by backup once the pipeline has finished.
+var backupStages = []stage{
+	{"check", (*backupJob).check, false},
+	{"pre-hook", (*backupJob).preHook, false},
+	{"export", (*backupJob).export, false},
+	{"validate", (*backupJob).validate, false},
+	{"post-hook", (*backupJob).postHook, true},
+	{"compress", (*backupJob).compress, false},
+	{"checksum", (*backupJob).checksum, false},
+	{"verify", (*backupJob).verify, false},
+	{"upload", (*backupJob).upload, false},
+	{"prune", (*backupJob).prune, false},
+}
+
+// backupJob is the state of a backup of one distribution as it passes through backupStages.
+type backupJob struct {
+	lg     *log.Logger
+	distro string
+
+	// done is set by a stage that completed the backup by itself, skipping the rest.
+	done bool
+
+	// The export format, which may change to tar with -vhd-fallback, and the distribution name used
+	// in file names.
+	format, name string
+	// The file names of the export and of the compressed file, and the names they are written under
+	// until the backup succeeds.
+	of, work, zipFinal, zipWork string
+	// The backup file produced and the name it is written under.
+	final, workFinal string
+
+	comp              compressor
+	zipped, compacted bool
+	// Whether the export was streamed straight into the compressed file.
+	streamed bool
+	// Whether the distribution was left running to be copied with -fsfreeze.
+	live bool
+	// Whether work is to be deleted once the compressed file has been checked, and whether the
+	// checksums showed it could be.
+	removeWork, intact bool
+	// Whether verify has moved the backup into place.
+	finalized bool
+	// Whether the upload was skipped on a metered connection, leaving the backup only on this machine.
+	unsent bool
+	// Bytes saved by compact.
+	saved int64
+	// The size of the backup file, recorded before -azure-delete-local can remove it.
+	size int64
+	// The files of the backup in the -generations slot being reused, removed once the new one is in
+	// place.
+	rotate []string
+	// The checksum of the uncompressed export, worked out while compressing it with -single-pass.
+	sum hash.Hash
+}
+
+// run runs every stage of the backup, returning the first error.
+func (j *backupJob) run() error {
+	// A cancelled backup leaves nothing half written behind. Once verify has moved the backup into
+	// place it is complete, and with -no-atomic the work files are the backup itself.
+	defer func() {
+		if runCtx.Err() == nil || j.finalized || j.work == "" || j.work == j.of {
+			return
+		}
+
+		os.Remove(j.work)
+		os.Remove(j.zipWork)
+		if j.workFinal != "" {
+			mf, _ := j.manifestNames()
+			os.Remove(j.workFinal + checksumAlgos[*sumalgo].ext)
+			os.Remove(mf)
+		}
+	}()
+
+	return j.runStages(backupStages)
+}
+
+// runStages runs stages in order. Once one fails or completes the backup, only those that always run
+// follow it. The first error is returned.
+func (j *backupJob) runStages(stages []stage) error {
+	var err error
+	for _, s := range stages {
+		if (err != nil || j.done) && !s.always {
+			continue
+		}
+
+		setPhase(j.distro, s.name)
+		if serr := s.run(j); err == nil {
+			err = serr
+		}
+	}
+
+	return err
+}
+
+// notFound returns the error for a distribution that isn't installed.
+func (j *backupJob) notFound() error {
+	return fmt.Errorf("distro %q not found in WSL, check installed distribution with \"%s %s\"", j.distro, wsl, wslList)
+}
+
+// terminate terminates the distribution, which exports made by tar inside it had to start, unless it
+// is being backed up while running.
+func (j *backupJob) terminate() {
+	if err := restoreRunState(j.distro, j.live); err != nil {
+		j.lg.Printf("Warning: error terminating %s: %v", j.distro, err)
+	}
+}
+
+// preHook stops -stop-services cleanly and terminates the distribution, which check left running.
+// A distribution copied while running with -fsfreeze is left running.
+func (j *backupJob) preHook() error {
+	// The distribution passed its checks so it won't be skipped, -quiet-on-skip has nothing to hide.
+	heldLog.release()
+
+	if len(*stopsvcs) == 0 {
+		return nil
+	}
+
+	if j.live {
+		return serviceCtl(j.lg, j.distro, "stop", *stopsvcs)
+	}
+
+	if err := stopServices(j.lg, j.distro); err != nil {
+		return err
+	}
+
+	return j.waitDisk()
+}
+
+// postHook starts -start-services. A failure to start them doesn't fail the backup.
+func (j *backupJob) postHook() error {
+	if len(*startsvc) == 0 {
+		return nil
+	}
+
+	if err := serviceCtl(j.lg, j.distro, "start", *startsvc); err != nil {
+		j.lg.Printf("Warning: %v", err)
+	}
+
+	return nil
+}
+
+// check makes sure the distribution is installed and ready to export.
+func (j *backupJob) check() error {
+	if *fsfreeze {
+		nfo, ok, err := findDistro(j.distro)
+		if err != nil {
+			return err
+		}
+		j.live = ok && nfo.state == "Running"
+	}
+
+	switch {
+	case j.live:
+	case len(*stopsvcs) > 0:
+		// The services can only be stopped while the distribution runs, pre-hook terminates it.
+		_, ok, err := findDistro(j.distro)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return j.notFound()
+		}
+	default:
+		d, err := distroCheck(j.lg, j.distro)
+		if err != nil {
+			return err
+		}
+
+		if !d {
+			return j.notFound()
+		}
+	}
+
+	if *bootpre {
+		if err := bootDistro(j.lg, j.distro, *bootwait); err != nil {
+			return err
+		}
+	}
+
+	if *trim {
+		if err := trimDistro(j.lg, j.distro); err != nil {
+			return err
+		}
+	}
+
+	if len(*paths) > 0 {
+		if err := checkPaths(j.distro); err != nil {
+			return err
+		}
+	}
+
+	if len(excludeGlobs) > 0 {
+		warnUnmatched(j.lg, j.distro)
+	}
+
+	// With -stop-services the distribution is still running, pre-hook waits for its disk instead.
+	if len(*stopsvcs) > 0 {
+		return nil
+	}
+
+	return j.waitDisk()
+}
+
+// waitDisk waits for nothing else to hold the disk of the distribution with -detect-locked-files.
+func (j *backupJob) waitDisk() error {
+	// Exports made by tar inside the distribution run it, so its disk is meant to be in use, as is
+	// the disk of a distribution copied while running.
+	if *locked && *resticr == "" && !distroTar() && !j.live {
+		return waitUnlocked(j.lg, j.distro)
+	}
+
+	return nil
+}
+
+// export names the backup and exports the distribution, straight into the compressed file when it
+// can. A -restic-repo backup is complete after this stage.
+func (j *backupJob) export() error {
+	if *resticr != "" {
+		id, err := resticBackup(j.lg, j.distro, *resticr)
+		if distroTar() {
+			j.terminate()
+		}
+		if err != nil {
+			return err
+		}
+		j.final, j.done = fmt.Sprintf("%s snapshot %s", *resticr, id), true
+		return nil
+	}
+
+	// If no output filename provided, create a sane one.
+	j.format, j.name = *outfmt, fileDistro(j.distro)
+	dir, err := outputDir()
+	if err != nil {
+		return err
+	}
+
+	j.of = *outfile
+	switch {
+	case *gens > 0:
+		if j.of, j.rotate, err = generationName(j.lg, dir, j.format, j.name, *gens); err != nil {
+			return err
+		}
+	case *outfile == "":
+		j.of = uniqueName(dir, j.format, j.name, compressors[string(*outzip)].ext)
+	case *outdir != "" && !filepath.IsAbs(j.of):
+		j.of = filepath.Join(*outdir, j.of)
+	}
+
+	// Write everything under a partial name until the whole backup has succeeded. A generation slot
+	// holds the previous backup, which isn't lost unless the new one succeeds, even with -no-atomic.
+	j.work = j.of
+	if !*noatom || *gens > 0 {
+		j.work = partialName(j.of)
+	}
+
+	// Compression may be skipped later for small exports.
+	j.comp = compressors[string(*outzip)]
+	j.zipped, j.compacted = *outzip != "", *compact
+
+	if *onepass {
+		j.sum = checksumAlgos[*sumalgo].new()
+	}
+
+	// Tar exports can be streamed straight into the compressed file, halving the disk space needed.
+	// This never leaves an uncompressed copy so it is skipped when -keep is used.
+	if j.zipped && j.format == "tar" && !*keep && compressMin == 0 {
+		if err := j.zipNames(); err != nil {
+			return err
+		}
+		err := compressExport(j.lg, j.comp, j.distro, j.zipWork, filepath.Base(j.of), j.sum)
+		switch {
+		case err == nil:
+			j.streamed = true
+		case distroTar():
+			// Falling back to wsl --export would silently ignore the exclusions and -paths.
+			return err
+		default:
+			j.lg.Printf("Streaming export failed, falling back to exporting then compressing: %v", err)
+			if j.sum != nil {
+				j.sum.Reset()
+			}
+		}
+	}
+
+	// Do the export.
+	switch {
+	case j.streamed:
+	case j.live:
+		if err := freezeCopy(j.lg, j.distro, j.work); err != nil {
+			return err
+		}
+	case distroTar():
+		if err := tarExport(j.lg, j.distro, j.work); err != nil {
+			return err
+		}
+	default:
+		err = wslExport(j.lg, j.distro, j.format, j.work)
+		if errors.Is(err, errVHDUnsupported) && *vhdfall {
+			j.lg.Printf("Warning: %v, falling back to a tar export.", err)
+			j.format = "tar"
+			j.of = strings.TrimSuffix(j.of, ".vhdx") + ".tar"
+			j.work = strings.TrimSuffix(j.work, ".vhdx") + ".tar"
+			err = wslExport(j.lg, j.distro, j.format, j.work)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if distroTar() {
+		j.terminate()
+	}
+
+	// -vhd-fallback may have changed the export to tar, so the compressed names follow it.
+	return j.zipNames()
+}
+
+// zipNames names the compressed file after the export. It normally goes next to the export but may be
+// put elsewhere with -compressed-dir.
+func (j *backupJob) zipNames() error {
+	j.zipWork, j.zipFinal = j.work+j.comp.ext, j.of+j.comp.ext
+	if *zipdir != "" {
+		if err := os.MkdirAll(*zipdir, 0755); err != nil {
+			return err
+		}
+		j.zipWork = filepath.Join(*zipdir, filepath.Base(j.work)+j.comp.ext)
+		j.zipFinal = filepath.Join(*zipdir, filepath.Base(j.of)+j.comp.ext)
+	}
+
+	return nil
+}
+
+// validate checks the export itself is sound.
+func (j *backupJob) validate() error {
+	if *vhdcheck && j.format == "vhdx" {
+		if err := verifyVHD(j.lg, j.work); err != nil {
+			return err
+		}
+	}
+
+	if *vmount && j.format == "vhdx" {
+		if err := mountVerify(j.lg, j.distro, j.work); err != nil {
+			return err
+		}
+	}
+
+	if *symscan && j.format == "tar" {
+		if err := symlinkScan(j.lg, j.distro); err != nil {
+			j.lg.Printf("Warning: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// compress compresses the export with -z or -c, unless it is below -compress-threshold.
+func (j *backupJob) compress() error {
+	if compressMin > 0 && !j.streamed {
+		fi, err := os.Stat(j.work)
+		if err != nil {
+			return err
+		}
+
+		if (j.zipped || j.compacted) && fi.Size() < compressMin {
+			j.lg.Printf("Export is only %d bytes, below the -compress-threshold of %d bytes, skipping compression.\n", fi.Size(), compressMin)
+			j.zipped, j.compacted = false, false
+		}
+	}
+
+	if j.zipped && !j.streamed {
+		if err := compressRoom(j.lg, j.work, j.zipWork); err != nil {
+			return err
+		}
+
+		if err := compressFile(j.lg, j.comp, j.work, j.zipWork, filepath.Base(j.of), j.sum); err != nil {
+			return err
+		}
+
+		// The original file is deleted last, once the compressed file has passed every check.
+		j.removeWork = !*keep
+	}
+
+	if j.compacted {
+		var err error
+		if j.saved, err = compactFile(j.lg, j.work); err != nil {
+			return fmt.Errorf("error compacting file: %v", err)
+		}
+	}
+
+	j.final, j.workFinal = j.of, j.work
+	if j.zipped {
+		j.final, j.workFinal = j.zipFinal, j.zipWork
+	}
+
+	return nil
+}
+
+// verify sanity checks the backup file, moves it and its checksums into place once it passes and writes
+// the files that go alongside it.
+func (j *backupJob) verify() error {
+	if minBytes > 0 {
+		if err := sizeCheck(j.workFinal, minBytes); err != nil {
+			return err
+		}
+	}
+
+	if maxBytes > 0 {
+		if err := maxSizeCheck(j.workFinal, maxBytes); err != nil {
+			if *maxfail {
+				return err
+			}
+			j.lg.Printf("Warning: %v", err)
+		}
+	}
+
+	if *verifcmd != "" {
+		if err := verifyCmd(j.lg, j.distro, j.workFinal); err != nil {
+			return err
+		}
+	}
+
+	// Everything succeeded, move the backup into place.
+	if err := finalize(j.workFinal, j.final); err != nil {
+		return err
+	}
+	j.finalized = true
+
+	if j.zipped && *keep {
+		if err := finalize(j.work, j.of); err != nil {
+			return err
+		}
+	}
+
+	mfWork, mf := j.manifestNames()
+	for _, s := range [][2]string{
+		{j.workFinal + checksumAlgos[*sumalgo].ext, j.final + checksumAlgos[*sumalgo].ext},
+		{mfWork, mf},
+	} {
+		if _, err := os.Stat(s[0]); err == nil {
+			if err := finalize(s[0], s[1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if j.removeWork && j.intact {
+		if err := os.Remove(j.work); err != nil {
+			j.lg.Printf("Warning: error removing %s after compressing it: %v", j.work, err)
+		}
+	} else if j.removeWork {
+		j.lg.Printf("Warning: keeping the uncompressed export %s since the compressed file could not be checked.\n", j.of)
+		if err := finalize(j.work, j.of); err != nil {
+			j.lg.Printf("Warning: %v", err)
+		}
+	}
+
+	rotateGeneration(j.lg, j.rotate, j.final, j.of, j.final+checksumAlgos[*sumalgo].ext, mf)
+
+	if *keeptime {
+		for _, fn := range []string{j.final, j.of} {
+			if _, err := os.Stat(fn); err == nil {
+				if err := os.Chtimes(fn, runStart, runStart); err != nil {
+					j.lg.Printf("Warning: error setting modification time of %s: %v", fn, err)
+				}
+			}
+		}
+	}
+
+	if *dedupe {
+		if err := dedupeBackup(j.lg, j.name, j.final); err != nil {
+			j.lg.Printf("Warning: %v", err)
+		}
+	}
+
+	j.lg.Print(green(fmt.Sprintf("Backup written to %s.", j.final)))
+
+	if *saveconf {
+		if err := captureConfig(j.lg, j.distro, j.of); err != nil {
+			j.lg.Printf("Warning: %v", err)
+		}
+	}
+
+	if *rscript {
+		if script, err := writeRestoreScript(j.distro, j.of, j.final); err != nil {
+			j.lg.Printf("Warning: error writing restore script: %v", err)
+		} else {
+			j.lg.Printf("Restore script written to %s.\n", script)
+		}
+	}
+
+	if *diskuse {
+		if err := diskUsage(j.lg, j.distro, j.of, *dudepth); err != nil {
+			j.lg.Printf("Warning: %v", err)
+		}
+	}
+
+	if *savewslc {
+		if err := saveWSLConfig(j.lg, j.of); err != nil {
+			j.lg.Printf("Warning: %v", err)
+		}
+	}
+
+	if *savereg {
+		if err := saveRegistry(j.distro, j.of+".registry.json"); err != nil {
+			j.lg.Printf("Warning: %v", err)
+		} else {
+			j.lg.Printf("Registry settings saved to %s.registry.json.\n", j.of)
+		}
+	}
+
+	return nil
+}
+
+// checksum writes the checksum and manifest of the backup under its partial name, for verify to move
+// into place with it. Whether they were written decides whether the uncompressed export can go.
+func (j *backupJob) checksum() error {
+	// Whether the checksum and manifest, which decompresses the backup, were written.
+	j.intact = true
+	if *checksum {
+		if _, err := writeChecksum(*sumalgo, j.workFinal, j.final); err != nil {
+			j.lg.Printf("Warning: %v", err)
+			j.intact = false
+		} else {
+			j.lg.Printf("Checksum written to %s%s.\n", j.final, checksumAlgos[*sumalgo].ext)
+		}
+	}
+
+	var content string
+	if j.sum != nil && j.zipped {
+		content = hex.EncodeToString(j.sum.Sum(nil))
+	}
+
+	if *manifest {
+		mfWork, mf := j.manifestNames()
+		if err := writeManifest(j.distro, j.format, *sumalgo, j.workFinal, j.final, mfWork, content, j.saved); err != nil {
+			j.lg.Printf("Warning: error writing manifest: %v", err)
+			j.intact = false
+		} else {
+			j.lg.Printf("Manifest written to %s.\n", mf)
+		}
+	}
+
+	return nil
+}
+
+// manifestNames returns the name the manifest is written under and the name verify moves it to. It
+// goes next to the backup file, in -compressed-dir if that is where the backup is.
+func (j *backupJob) manifestNames() (string, string) {
+	return uncompressedName(j.workFinal) + ".manifest.json", uncompressedName(j.final) + ".manifest.json"
+}
+
+// upload uploads the backup to -azure-container.
+func (j *backupJob) upload() error {
+	if fi, err := os.Stat(j.final); err == nil {
+		j.size = fi.Size()
+	}
+	if *azure == "" {
+		return nil
+	}
+
+	err := azureUpload(j.lg, *azure, j.final)
+	if errors.Is(err, errMetered) {
+		j.unsent = true
+		return nil
+	}
+
+	return err
+}
+
+// prune deletes old backups with -keep-last and -keep-days, unless the new backup wasn't uploaded.
+func (j *backupJob) prune() error {
+	if j.unsent && (*keeplast > 0 || *keepdays > 0) {
+		j.lg.Println("Not deleting old backups since the new one wasn't uploaded.")
+		return nil
+	}
+
+	if *keeplast > 0 || *keepdays > 0 {
+		if err := pruneBackups(j.lg, j.name, *keeplast, *keepdays, false); err != nil {
+			j.lg.Printf("Warning: %v", err)
+		}
+	}
+
+	return nil
+}
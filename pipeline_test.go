@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// stubStages returns backupStages with each stage replaced by one that records it ran in ran, and
+// then does what stubs has for it.
+func stubStages(ran *[]string, stubs map[string]func(j *backupJob) error) []stage {
+	var stages []stage
+	for _, s := range backupStages {
+		name, stub := s.name, stubs[s.name]
+		stages = append(stages, stage{name, func(j *backupJob) error {
+			*ran = append(*ran, name)
+			if stub != nil {
+				return stub(j)
+			}
+			return nil
+		}, s.always})
+	}
+
+	return stages
+}
+
+func TestRunStages(t *testing.T) {
+	errFail := errors.New("failed")
+	fail := func(*backupJob) error { return errFail }
+
+	for _, tc := range []struct {
+		name    string
+		stubs   map[string]func(j *backupJob) error
+		want    []string
+		wantErr error
+	}{{
+		name: "success",
+		want: []string{"check", "pre-hook", "export", "validate", "post-hook", "compress", "checksum", "verify", "upload", "prune"},
+	}, {
+		name:    "check fails",
+		stubs:   map[string]func(j *backupJob) error{"check": fail},
+		want:    []string{"check", "post-hook"},
+		wantErr: errFail,
+	}, {
+		name:    "export fails",
+		stubs:   map[string]func(j *backupJob) error{"export": fail},
+		want:    []string{"check", "pre-hook", "export", "post-hook"},
+		wantErr: errFail,
+	}, {
+		name:    "compress fails after post-hook",
+		stubs:   map[string]func(j *backupJob) error{"compress": fail},
+		want:    []string{"check", "pre-hook", "export", "validate", "post-hook", "compress"},
+		wantErr: errFail,
+	}, {
+		name:    "upload fails",
+		stubs:   map[string]func(j *backupJob) error{"upload": fail},
+		want:    []string{"check", "pre-hook", "export", "validate", "post-hook", "compress", "checksum", "verify", "upload"},
+		wantErr: errFail,
+	}, {
+		name: "export completes the backup",
+		stubs: map[string]func(j *backupJob) error{"export": func(j *backupJob) error {
+			j.done = true
+			return nil
+		}},
+		want: []string{"check", "pre-hook", "export", "post-hook"},
+	}, {
+		name: "first error is returned",
+		stubs: map[string]func(j *backupJob) error{
+			"export":    fail,
+			"post-hook": func(*backupJob) error { return errors.New("post-hook failed") },
+		},
+		want:    []string{"check", "pre-hook", "export", "post-hook"},
+		wantErr: errFail,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var ran []string
+			j := &backupJob{distro: "test"}
+			err := j.runStages(stubStages(&ran, tc.stubs))
+			if !errors.Is(err, tc.wantErr) || (err != nil) != (tc.wantErr != nil) {
+				t.Errorf("runStages() = %v, want %v", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(ran, tc.want) {
+				t.Errorf("runStages() ran %v, want %v", ran, tc.want)
+			}
+		})
+	}
+}
+
+func TestPruneSkippedWhenUnsent(t *testing.T) {
+	defer func(n int) { *keeplast = n }(*keeplast)
+	*keeplast = 1
+
+	var ran []string
+	var buf bytes.Buffer
+	stages := stubStages(&ran, map[string]func(j *backupJob) error{"upload": func(j *backupJob) error {
+		j.unsent = true
+		return nil
+	}})
+	// The real prune, which must not delete anything.
+	for i := range stages {
+		if stages[i].name == "prune" {
+			stages[i].run = (*backupJob).prune
+		}
+	}
+
+	j := &backupJob{lg: log.New(&buf, "", 0), distro: "test", name: "test"}
+	if err := j.runStages(stages); err != nil {
+		t.Fatalf("runStages() = %v", err)
+	}
+	if !strings.Contains(buf.String(), "Not deleting old backups") {
+		t.Errorf("prune ran after the upload was skipped, logged %q", buf.String())
+	}
+}
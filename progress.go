@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often progress events are written while a phase runs.
+const progressInterval = time.Second
+
+var (
+	// progressOut receives JSON progress events, one per line, when -progress-file is set.
+	progressOut io.Writer
+	progressMu  sync.Mutex
+)
+
+// progressEvent is one line written to -progress-file.
+type progressEvent struct {
+	Time    time.Time `json:"time"`
+	Phase   string    `json:"phase"`
+	File    string    `json:"file"`
+	Done    int64     `json:"bytes_done"`
+	Total   int64     `json:"total,omitempty"`
+	Percent float64   `json:"percent,omitempty"`
+	Final   bool      `json:"final,omitempty"`
+}
+
+// reportProgress writes a progress event for phase on file. A total of 0 means it isn't known.
+func reportProgress(phase, file string, done, total int64, final bool) {
+	if progressOut == nil {
+		return
+	}
+
+	ev := progressEvent{Time: time.Now(), Phase: phase, File: file, Done: done, Total: total, Final: final}
+	if total > 0 {
+		ev.Percent = float64(done) * 100 / float64(total)
+	}
+
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	json.NewEncoder(progressOut).Encode(&ev)
+}
+
+// progressCounter is a writer counting the bytes written through it for progress events, for use with
+// io.TeeReader or io.MultiWriter.
+type progressCounter struct {
+	phase, file string
+	total, done int64
+	last        time.Time
+}
+
+// newProgress returns a progressCounter for phase writing file, which will be total bytes if known.
+func newProgress(phase, file string, total int64) *progressCounter {
+	return &progressCounter{phase: phase, file: file, total: total, last: time.Now()}
+}
+
+func (p *progressCounter) Write(b []byte) (int, error) {
+	p.set(p.done + int64(len(b)))
+	return len(b), nil
+}
+
+// set records that done bytes have been processed, for progress reported as a running total.
+func (p *progressCounter) set(done int64) {
+	p.done = done
+	if time.Since(p.last) >= progressInterval {
+		p.last = time.Now()
+		reportProgress(p.phase, p.file, p.done, p.total, false)
+	}
+}
+
+// finish writes the final event of the phase.
+func (p *progressCounter) finish() {
+	reportProgress(p.phase, p.file, p.done, p.total, true)
+}
+
+// watchFile writes progress events for phase from the size of fn as another process writes it, until
+// the returned function is called.
+func watchFile(phase, fn string) func() {
+	if progressOut == nil {
+		return func() {}
+	}
+
+	size := func() int64 {
+		if fi, err := os.Stat(fn); err == nil {
+			return fi.Size()
+		}
+		return 0
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(progressInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				reportProgress(phase, fn, size(), 0, false)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+		reportProgress(phase, fn, size(), 0, true)
+	}
+}
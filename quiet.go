@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// heldWriter holds back what is written to it until released, for -quiet-on-skip to drop the log of
+// a run where nothing was backed up.
+type heldWriter struct {
+	mu       sync.Mutex
+	w        io.Writer
+	buf      bytes.Buffer
+	released bool
+}
+
+// heldLog holds the log with -quiet-on-skip, nil otherwise.
+var heldLog *heldWriter
+
+func (h *heldWriter) Write(b []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.released {
+		return h.w.Write(b)
+	}
+
+	return h.buf.Write(b)
+}
+
+// release writes out everything held so far and passes anything written afterwards straight through.
+func (h *heldWriter) release() {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.released {
+		h.w.Write(h.buf.Bytes())
+		h.buf.Reset()
+		h.released = true
+	}
+}
+
+// discard drops everything held so far, returning true if nothing had been released already.
+func (h *heldWriter) discard() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf.Reset()
+	return !h.released
+}
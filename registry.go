@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// installValues are the registry values describing where and how a distribution is installed. wsl
+// --import sets them for the new install, so restoring the saved settings leaves them alone.
+var installValues = []string{"BasePath", "DistributionName", "PackageFamilyName", "State", "Version", "VhdFileName"}
+
+// regValue is a registry value of a distribution along with its registry type so it can be written
+// back exactly.
+type regValue struct {
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// integer returns the value of a DWORD or QWORD.
+func (v regValue) integer() (uint64, error) {
+	n, ok := v.Value.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("%v is not a number", v.Value)
+	}
+
+	i, err := strconv.ParseUint(string(n), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%v is not a %s", v.Value, v.Type)
+	}
+
+	return i, nil
+}
+
+// strings returns the value of a MULTI_SZ.
+func (v regValue) strings() ([]string, error) {
+	l, ok := v.Value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v is not a list of strings", v.Value)
+	}
+
+	ss := make([]string, len(l))
+	for i, e := range l {
+		if ss[i], ok = e.(string); !ok {
+			return nil, fmt.Errorf("%v is not a string", e)
+		}
+	}
+
+	return ss, nil
+}
+
+// distroRegistry holds the per distribution settings WSL keeps in the Lxss registry key, such as the
+// default user, which "wsl --export" does not carry.
+type distroRegistry struct {
+	Distribution string              `json:"distribution"`
+	Values       map[string]regValue `json:"values"`
+}
+
+// saveRegistry writes the registry settings of distro to fn as JSON.
+func saveRegistry(distro, fn string) error {
+	vals, err := distroSettings(distro)
+	if err != nil {
+		return fmt.Errorf("error reading registry settings: %v", err)
+	}
+
+	b, err := json.MarshalIndent(&distroRegistry{distro, vals}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(fn, b, 0644)
+}
+
+// readRegistry returns the registry settings saved alongside backup fn by -registry, or false if
+// there are none. Numbers are kept as json.Number so a QWORD isn't rounded.
+func readRegistry(fn string) (*distroRegistry, bool) {
+	b, err := os.ReadFile(uncompressedName(fn) + ".registry.json")
+	if err != nil {
+		return nil, false
+	}
+
+	var reg distroRegistry
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&reg); err != nil {
+		return nil, false
+	}
+
+	for _, n := range installValues {
+		delete(reg.Values, n)
+	}
+
+	return &reg, true
+}
+
+// restoreRegistry applies the registry settings saved alongside backup fn by -registry to distro,
+// other than those in skip, returning the names of those applied.
+func restoreRegistry(distro, fn string, skip ...string) ([]string, error) {
+	reg, ok := readRegistry(fn)
+	if !ok {
+		return nil, nil
+	}
+
+	var names []string
+	for n := range reg.Values {
+		if slices.Contains(skip, n) {
+			delete(reg.Values, n)
+			continue
+		}
+		names = append(names, n)
+	}
+	slices.Sort(names)
+
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	return names, setDistroSettings(distro, reg.Values)
+}
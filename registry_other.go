@@ -0,0 +1,25 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+// distroSettings is only supported on Windows where WSL keeps its registry.
+func distroSettings(distro string) (map[string]regValue, error) {
+	return nil, errors.New("reading WSL registry settings is only supported on Windows")
+}
+
+// setDistroSettings is only supported on Windows where WSL keeps its registry.
+func setDistroSettings(distro string, vals map[string]regValue) error {
+	return errors.New("setting WSL registry settings is only supported on Windows")
+}
+
+// setDefaultUID is only supported on Windows where WSL keeps its registry.
+func setDefaultUID(distro string, uid uint32) error {
+	return errors.New("setting the WSL default user is only supported on Windows")
+}
+
+// renameDistro is only supported on Windows where WSL keeps its registry.
+func renameDistro(distro, name string) error {
+	return errors.New("renaming a WSL distribution is only supported on Windows")
+}
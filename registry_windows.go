@@ -0,0 +1,168 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// lxssKey is where WSL registers distributions, one subkey per distribution named by its GUID.
+const lxssKey = `Software\Microsoft\Windows\CurrentVersion\Lxss`
+
+// distroKey opens the Lxss subkey for distro with the given access.
+func distroKey(distro string, access uint32) (registry.Key, error) {
+	lxss, err := registry.OpenKey(registry.CURRENT_USER, lxssKey, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return 0, err
+	}
+	defer lxss.Close()
+
+	names, err := lxss.ReadSubKeyNames(-1)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, n := range names {
+		k, err := registry.OpenKey(lxss, n, access|registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+
+		if name, _, err := k.GetStringValue("DistributionName"); err == nil && strings.EqualFold(name, distro) {
+			return k, nil
+		}
+		k.Close()
+	}
+
+	return 0, fmt.Errorf("distribution %s not found under HKCU\\%s", distro, lxssKey)
+}
+
+// distroSettings returns the registry values WSL stores for distro.
+func distroSettings(distro string) (map[string]regValue, error) {
+	k, err := distroKey(distro, registry.QUERY_VALUE)
+	if err != nil {
+		return nil, err
+	}
+	defer k.Close()
+
+	names, err := k.ReadValueNames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	vals := make(map[string]regValue)
+	for _, n := range names {
+		_, typ, err := k.GetValue(n, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var v interface{}
+		var t string
+		switch typ {
+		case registry.SZ, registry.EXPAND_SZ:
+			v, _, err = k.GetStringValue(n)
+			t = "SZ"
+			if typ == registry.EXPAND_SZ {
+				t = "EXPAND_SZ"
+			}
+		case registry.MULTI_SZ:
+			v, _, err = k.GetStringsValue(n)
+			t = "MULTI_SZ"
+		case registry.DWORD, registry.QWORD:
+			v, _, err = k.GetIntegerValue(n)
+			t = "DWORD"
+			if typ == registry.QWORD {
+				t = "QWORD"
+			}
+		default:
+			// WSL doesn't use other types.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		vals[n] = regValue{t, v}
+	}
+
+	return vals, nil
+}
+
+// setDistroSettings writes vals, as read by distroSettings, to the registry values of distro.
+func setDistroSettings(distro string, vals map[string]regValue) error {
+	k, err := distroKey(distro, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+
+	for n, v := range vals {
+		if err := setValue(k, n, v); err != nil {
+			return fmt.Errorf("error setting %s: %v", n, err)
+		}
+	}
+
+	return nil
+}
+
+// setValue writes v to the value name of k.
+func setValue(k registry.Key, name string, v regValue) error {
+	switch v.Type {
+	case "SZ", "EXPAND_SZ":
+		s, ok := v.Value.(string)
+		if !ok {
+			return fmt.Errorf("%v is not a string", v.Value)
+		}
+		if v.Type == "EXPAND_SZ" {
+			return k.SetExpandStringValue(name, s)
+		}
+		return k.SetStringValue(name, s)
+	case "MULTI_SZ":
+		ss, err := v.strings()
+		if err != nil {
+			return err
+		}
+		return k.SetStringsValue(name, ss)
+	case "DWORD":
+		i, err := v.integer()
+		if err != nil || i > math.MaxUint32 {
+			return fmt.Errorf("%v is not a DWORD", v.Value)
+		}
+		return k.SetDWordValue(name, uint32(i))
+	case "QWORD":
+		i, err := v.integer()
+		if err != nil {
+			return err
+		}
+		return k.SetQWordValue(name, i)
+	}
+
+	return fmt.Errorf("unknown registry type %s", v.Type)
+}
+
+// setDefaultUID sets the user ID WSL logs in to distro as.
+func setDefaultUID(distro string, uid uint32) error {
+	k, err := distroKey(distro, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+
+	return k.SetDWordValue("DefaultUid", uid)
+}
+
+// renameDistro renames distro to name. WSL has no command for it but reads the name from the registry.
+func renameDistro(distro, name string) error {
+	k, err := distroKey(distro, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+
+	return k.SetStringValue("DistributionName", name)
+}
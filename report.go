@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"time"
+)
+
+// reportPage is the page written by -report-html. The CSS is embedded so the file can be mailed or
+// opened from anywhere on its own.
+var reportPage = template.Must(template.New("report").Funcs(template.FuncMap{
+	"bytes":    humanBytes,
+	"duration": func(s float64) time.Duration { return time.Duration(s * float64(time.Second)).Round(time.Second) },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>WSL backup report {{.Time.Format "2006-01-02 15:04"}}</title>
+<style>
+body { font-family: "Segoe UI", sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 0.4em 1em; border-bottom: 1px solid #ddd; text-align: left; }
+th { background: #f4f4f4; }
+td.num { text-align: right; }
+.success { color: #1a7f37; font-weight: bold; }
+.failure { color: #cf222e; font-weight: bold; }
+.skipped { color: #9a6700; font-weight: bold; }
+.meta { color: #666; }
+</style>
+</head>
+<body>
+<h1>WSL backup report</h1>
+<p class="meta">Run {{.RunID}} at {{.Time.Format "2006-01-02 15:04:05"}}:
+{{if .Success}}<span class="success">all backups succeeded</span>{{else}}<span class="failure">some backups failed</span>{{end}}</p>
+<h2>This run</h2>
+<table>
+<tr><th>Distribution</th><th>Result</th><th>Size</th><th>Duration</th><th>File or error</th></tr>
+{{range .Results}}<tr><td>{{.Distro}}</td><td class="{{.Result}}">{{.Result}}</td><td class="num">{{bytes .Size}}</td><td class="num">{{duration .Duration}}</td><td>{{if .Error}}{{.Error}}{{else}}{{.File}}{{end}}</td></tr>
+{{end}}</table>
+<h2>Backups in {{.Dir}}</h2>
+{{if .Backups}}<table>
+<tr><th>Distribution</th><th>Date</th><th>Format</th><th>Compression</th><th>Size</th><th>File</th></tr>
+{{range .Backups}}<tr><td>{{.Distro}}</td><td>{{.Time.Format "2006-01-02 15:04"}}</td><td>{{.Format}}</td><td>{{.Compression}}</td><td class="num">{{bytes .Size}}</td><td>{{.Path}}</td></tr>
+{{end}}</table>{{else}}<p class="meta">No backups found.</p>{{end}}
+</body>
+</html>
+`))
+
+// reportBackup is a row of the stored backups table in the -report-html page.
+type reportBackup struct {
+	Distro string
+	storedBackupJSON
+}
+
+// writeReport writes an HTML summary of results and of the backups in dir to fn. Every value is
+// escaped by html/template.
+func writeReport(fn, dir string, results []result) error {
+	data := struct {
+		runStatus
+		Dir     string
+		Backups []reportBackup
+	}{runStatus: runStatus{RunID: runID, Time: runStart, Success: true}, Dir: dir}
+
+	for _, r := range results {
+		data.Results = append(data.Results, r.toJSON())
+		if r.err != nil && !r.skipped() {
+			data.Success = false
+		}
+	}
+
+	list, err := scanBackups(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range list {
+		data.Backups = append(data.Backups, reportBackup{e.name.distro, storedBackupJSON{
+			Path:        e.path,
+			Time:        e.name.time,
+			Size:        e.size,
+			Format:      e.name.format,
+			Compression: e.comp,
+		}})
+	}
+
+	var b bytes.Buffer
+	if err := reportPage.Execute(&b, &data); err != nil {
+		return err
+	}
+
+	return writeAtomic(fn, b.Bytes())
+}
+
+// humanBytes formats n bytes with a binary unit, e.g. "1.5 GiB".
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"time"
+)
+
+// restic is the restic command, it reads the repository password from RESTIC_PASSWORD or
+// RESTIC_PASSWORD_FILE itself.
+const restic = "restic"
+
+// resticExitWait is how long to wait for restic to exit after the export into it fails, to tell
+// whether restic exiting is what stopped the export.
+const resticExitWait = time.Second
+
+// resticSummary is the last JSON message of "restic backup --json".
+type resticSummary struct {
+	MessageType string `json:"message_type"`
+	SnapshotID  string `json:"snapshot_id"`
+	DataAdded   int64  `json:"data_added"`
+}
+
+// resticBackup streams a tar export of distro into a new snapshot in the restic repository repo,
+// tagged with the distribution name and the time of the backup as in file names, and returns the
+// snapshot ID. restic deduplicates the tar against earlier snapshots so each backup only stores what
+// changed.
+func resticBackup(lg *log.Logger, distro, repo string) (string, error) {
+	name := outputName("tar", distro)
+	lg.Printf("Exporting distribution %q into restic repository %q as %s...\n", distro, repo, name)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(restic, "-r", repo, "backup", "--json", "--stdin", "--stdin-filename", name, "--tag", distro, "--tag", runStart.Format("200601021504"))
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("error starting restic: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	failed := func(err error) error {
+		return fmt.Errorf("restic backup failed: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	p := newProgress("export", name, 0)
+	if err := runExport(lg, exportCmd(distro), io.MultiWriter(in, p)); err != nil {
+		// An export cut off by restic exiting failed because of restic, which says why.
+		select {
+		case werr := <-done:
+			if werr == nil {
+				werr = errors.New("exited before the export was complete")
+			}
+			return "", failed(werr)
+		case <-time.After(resticExitWait):
+		}
+
+		// Kill restic before closing its input so it doesn't save the partial export as a snapshot.
+		cmd.Process.Kill()
+		in.Close()
+		<-done
+		return "", err
+	}
+	p.finish()
+
+	in.Close()
+	if err := <-done; err != nil {
+		return "", failed(err)
+	}
+
+	sc := bufio.NewScanner(&stdout)
+	for sc.Scan() {
+		var sum resticSummary
+		if json.Unmarshal(sc.Bytes(), &sum) == nil && sum.MessageType == "summary" && sum.SnapshotID != "" {
+			lg.Printf("Saved restic snapshot %s, adding %d bytes to the repository.\n", sum.SnapshotID, sum.DataAdded)
+			return sum.SnapshotID, nil
+		}
+	}
+
+	return "", errors.New("restic backup succeeded but did not report a snapshot ID")
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// decompressBackup extracts the backup stored in the compressed file fn into dir and returns the
+// extracted filename.
+func decompressBackup(fn, dir string) (string, error) {
+	rc, name, err := openCompressed(fn)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	out := filepath.Join(dir, "wsl2backup-restore-"+filepath.Base(name))
+	log.Printf("Decompressing %s to %s...\n", fn, out)
+
+	f, err := os.Create(out)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		os.Remove(out)
+		return "", fmt.Errorf("error decompressing %s: %v", fn, err)
+	}
+
+	return out, f.Close()
+}
+
+// extractBundle extracts the backup of distro in the -bundle file fn into dir, along with the files
+// saved alongside it, returning the extracted backup and every file extracted.
+func extractBundle(fn, distro, dir string) (string, []string, error) {
+	zr, err := zip.OpenReader(fn)
+	if err != nil {
+		return "", nil, err
+	}
+	defer zr.Close()
+
+	var export string
+	var distros []string
+	for _, f := range zr.File {
+		if bn, ok := parseBackupName(f.Name); ok && bn.ext == "" {
+			distros = append(distros, bn.distro)
+			if strings.EqualFold(bn.distro, distro) {
+				export = f.Name
+			}
+		}
+	}
+	if export == "" {
+		return "", nil, fmt.Errorf("no backup of %s in %s, choose one of %s with -distro", distro, fn, strings.Join(distros, ", "))
+	}
+
+	log.Printf("Extracting the backup of %s from %s to %s...\n", distro, fn, dir)
+	var files []string
+	for _, f := range zr.File {
+		if f.Name != export && !strings.HasPrefix(f.Name, export+".") {
+			continue
+		}
+
+		out := filepath.Join(dir, "wsl2backup-restore-"+filepath.Base(f.Name))
+		files = append(files, out)
+		if err := extractFile(f, out); err != nil {
+			return "", files, fmt.Errorf("error extracting %s from %s: %v", f.Name, fn, err)
+		}
+	}
+
+	return filepath.Join(dir, "wsl2backup-restore-"+filepath.Base(export)), files, nil
+}
+
+// extractFile writes the contents of the ZIP entry f to out.
+func extractFile(f *zip.File, out string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	o, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(o, rc); err != nil {
+		o.Close()
+		return err
+	}
+
+	return o.Close()
+}
+
+// wslCompatible returns an error if the manifest of the backup fn says it was made with a different
+// major version of WSL than the one installed. Backups without a manifest or WSL version pass.
+func wslCompatible(fn string) error {
+	m, err := readManifest(fn)
+	if err != nil || m.WSLVersion == "" {
+		return nil
+	}
+
+	v, err := wslVersion()
+	if err != nil {
+		return fmt.Errorf("could not check the backup was made with a compatible WSL: %v", err)
+	}
+
+	major := func(v string) string {
+		m, _, _ := strings.Cut(v, ".")
+		return m
+	}
+	if major(v) != major(m.WSLVersion) {
+		return fmt.Errorf("%s was made with WSL %s but WSL %s is installed, the import may not work", fn, m.WSLVersion, v)
+	}
+
+	return nil
+}
+
+// restoreBackup imports the backup file fn as a new distribution called name installed in dir. An
+// existing distribution called name is only replaced with replace, once the user confirms it or
+// assumeYes is set. The backup is imported under a temporary name first and the existing
+// distribution is only unregistered once that has succeeded.
+func restoreBackup(fn, name, dir string, replace, assumeYes bool) error {
+	distros, err := listDistros()
+	if err != nil {
+		return err
+	}
+
+	var existing string
+	for _, d := range distros {
+		if strings.EqualFold(d.name, name) {
+			existing = d.name
+		}
+	}
+
+	if existing != "" {
+		if !replace {
+			return fmt.Errorf("a distribution called %s already exists, choose another -name or use -replace", existing)
+		}
+
+		log.Print(red(fmt.Sprintf("WARNING: -replace will unregister %s, permanently deleting it and everything in it, and restore %s in its place.", existing, fn)))
+		if !assumeYes {
+			ok, err := confirm(fmt.Sprintf("Unregister %s and replace it with %s?", existing, fn))
+			if err != nil {
+				return fmt.Errorf("not replacing %s: %v", existing, err)
+			}
+			if !ok {
+				return fmt.Errorf("not replacing %s", existing)
+			}
+		}
+
+		// The existing distribution is still there while the backup is imported.
+		if vhd, err := liveVHDX(existing); err == nil && strings.EqualFold(filepath.Clean(filepath.Dir(vhd)), filepath.Clean(dir)) {
+			return fmt.Errorf("%s is installed in %s, choose another -install-dir to replace it", existing, dir)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// side is the backup the files saved alongside it are named after.
+	side := fn
+	if bn, ok := parseBackupName(fn); ok && bn.format == "bundle" {
+		export, files, err := extractBundle(fn, *distro, dir)
+		defer func() {
+			for _, f := range files {
+				os.Remove(f)
+			}
+		}()
+		if err != nil {
+			return err
+		}
+		side = export
+	}
+
+	if err := wslCompatible(side); err != nil {
+		if *strict {
+			return err
+		}
+		log.Printf("Warning: %v", err)
+	}
+
+	src := side
+	out, streamed, err := extractStream(side, dir)
+	switch {
+	case err != nil:
+		return err
+	case streamed:
+		src = out
+		defer os.Remove(src)
+	case uncompressedName(side) != side:
+		if src, err = decompressBackup(side, dir); err != nil {
+			return err
+		}
+		defer os.Remove(src)
+	}
+
+	args := []string{"--import", name, dir, src}
+	if strings.EqualFold(filepath.Ext(src), ".vhdx") {
+		args = append(args, "--vhd")
+	}
+
+	// A replacement is imported under a temporary name so the existing distribution survives a
+	// failed import.
+	as := name
+	if existing != "" {
+		as = fmt.Sprintf("%s-restore-%s", name, runID)
+		args[1] = as
+	}
+
+	log.Printf("Importing %s as distribution %q in %s...\n", fn, as, dir)
+	res, err := wslArgs(args...)
+	if err != nil {
+		log.Printf("Failed: %s\n", res)
+		return err
+	}
+	log.Printf("Import succeeded: %s", res)
+
+	if existing != "" {
+		log.Print(red(fmt.Sprintf("Unregistering %s to replace it...", existing)))
+		if res, err := wslArgs("--unregister", existing); err != nil {
+			return fmt.Errorf("error unregistering %s, the backup is imported as %s: %v %s", existing, as, err, res)
+		}
+		log.Printf("Unregistered %s.\n", existing)
+
+		if err := renameDistro(as, name); err != nil {
+			return fmt.Errorf("error renaming %s to %s: %v", as, name, err)
+		}
+		log.Printf("Renamed %s to %s.\n", as, name)
+	}
+
+	if *savewslc {
+		if err := restoreWSLConfig(side); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	// wsl --import leaves root as the default user and the other settings at their defaults, so put
+	// back those saved with -registry. -default-user overrides the saved user.
+	var skip []string
+	if *defuser != "" {
+		skip = append(skip, "DefaultUid")
+	}
+	applied, err := restoreRegistry(name, side, skip...)
+	if err != nil {
+		return fmt.Errorf("error restoring the registry settings saved with the backup: %v", err)
+	}
+	if len(applied) > 0 {
+		log.Printf("Restored registry settings %s saved with the backup.\n", strings.Join(applied, ", "))
+	}
+
+	if *defuser != "" {
+		return setDefaultUser(name, *defuser)
+	}
+
+	return nil
+}
+
+// restoreWSLConfig puts the .wslconfig saved alongside backup fn back in place. Any existing
+// .wslconfig is kept as .wslconfig.bak.
+func restoreWSLConfig(fn string) error {
+	side := uncompressedName(fn) + ".wslconfig"
+	if _, err := os.Stat(side); errors.Is(err, fs.ErrNotExist) {
+		log.Printf("No %s saved with the backup, leaving .wslconfig alone.\n", side)
+		return nil
+	}
+
+	dst, err := wslConfigPath()
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(dst); err == nil {
+		if err := copyFile(dst, dst+".bak"); err != nil {
+			return fmt.Errorf("error backing up %s: %v", dst, err)
+		}
+		log.Printf("Existing %s saved as %s.bak.\n", dst, dst)
+	}
+
+	if err := copyFile(side, dst); err != nil {
+		return fmt.Errorf("error restoring %s: %v", dst, err)
+	}
+	log.Printf("Restored %s from %s, run \"%s --shutdown\" for it to take effect.\n", dst, side, wsl)
+
+	return nil
+}
+
+// userID returns the ID of user in distro, or an error if there is no such user.
+func userID(distro, user string) (uint32, error) {
+	res, err := wslExec(distro, "id", "-u", user)
+	if err != nil {
+		return 0, fmt.Errorf("user %s not found in %s: %v", user, distro, err)
+	}
+
+	uid, err := strconv.ParseUint(strings.TrimSpace(string(res)), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected user ID %q for %s", res, user)
+	}
+
+	return uint32(uid), nil
+}
+
+// setDefaultUser makes user the default user of distro.
+func setDefaultUser(distro, user string) error {
+	uid, err := userID(distro, user)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Setting default user of %s to %s (%d)...\n", distro, user, uid)
+	if err := setDefaultUID(distro, uid); err != nil {
+		return err
+	}
+
+	// Looking up the user started the distribution, terminate it so the new default applies.
+	_, err = wslArgs("--terminate", distro)
+	return err
+}
+
+// psQuote quotes s as a PowerShell single quoted string.
+func psQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// writeRestoreScript writes a PowerShell script to fn + ".restore.ps1" that restores distro from the
+// backup file final, which is the export fn possibly compressed. The script expects to sit next to
+// the backup, unless it was put in -compressed-dir, and takes the install directory and distribution
+// name as parameters.
+func writeRestoreScript(distro, fn, final string) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Restores the %s distribution from %s, backed up %s.\r\n", distro, filepath.Base(final), runStart.Format("2006-01-02 15:04"))
+	fmt.Fprintf(&b, "param([string]$InstallDir = %s, [string]$Name = %s)\r\n", psQuote(`C:\WSL\`+distro), psQuote(distro))
+	fmt.Fprintf(&b, "$ErrorActionPreference = 'Stop'\r\n")
+	if filepath.Dir(final) == filepath.Dir(fn) {
+		fmt.Fprintf(&b, "$backup = Join-Path $PSScriptRoot %s\r\n", psQuote(filepath.Base(final)))
+	} else {
+		// With -compressed-dir the backup is somewhere else.
+		abs, err := filepath.Abs(final)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "$backup = %s\r\n", psQuote(abs))
+	}
+
+	var vhd string
+	if strings.EqualFold(filepath.Ext(fn), ".vhdx") {
+		vhd = " --vhd"
+	}
+
+	switch strings.ToLower(filepath.Ext(final)) {
+	case ".vhdx", ".tar":
+		fmt.Fprintf(&b, "wsl --import $Name $InstallDir $backup%s\r\n", vhd)
+	case ".zip":
+		fmt.Fprintf(&b, "$tmp = Join-Path ([IO.Path]::GetTempPath()) ('wsl2backup-restore-' + [guid]::NewGuid())\r\n")
+		fmt.Fprintf(&b, "Expand-Archive -Path $backup -DestinationPath $tmp\r\n")
+		fmt.Fprintf(&b, "try { wsl --import $Name $InstallDir (Join-Path $tmp %s)%s } finally { Remove-Item -Recurse -Force $tmp }\r\n", psQuote(filepath.Base(fn)), vhd)
+	default:
+		// PowerShell can't decompress gzip, lz4, zstd or brotli by itself, wsl2backup does it while restoring.
+		fmt.Fprintf(&b, "wsl2backup -restore $backup -name $Name -install-dir $InstallDir\r\n")
+	}
+	fmt.Fprintf(&b, "if ($LASTEXITCODE -ne 0) { throw \"Restore failed with exit code $LASTEXITCODE\" }\r\n")
+
+	script := fn + ".restore.ps1"
+	return script, os.WriteFile(script, []byte(b.String()), 0644)
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// backupSet is one backup along with its compressed copy and sidecar files, which all share the name
+// outputName gave the export.
+type backupSet struct {
+	name  backupName
+	files []string
+}
+
+// distroBackups returns the timestamped backups of distro in -dir, newest first.
+func distroBackups(distro string) ([]*backupSet, error) {
+	paths, err := existingBackups()
+	if err != nil {
+		return nil, err
+	}
+
+	sets := make(map[string]*backupSet)
+	for _, p := range paths {
+		bn, ok := parseBackupName(p)
+		if !ok || !strings.EqualFold(bn.distro, distro) {
+			continue
+		}
+
+		// Group on the name of the export itself, which is the same for the compressed copy in
+		// -compressed-dir.
+		key := filepath.Base(strings.TrimSuffix(p, bn.ext))
+		if sets[key] == nil {
+			sets[key] = &backupSet{name: bn}
+		}
+		sets[key].files = append(sets[key].files, p)
+	}
+
+	var list []*backupSet
+	for _, bs := range sets {
+		list = append(list, bs)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name.newer(list[j].name) })
+
+	return list, nil
+}
+
+// pruneBackups deletes old backups of distro, keeping the newest n and any made in the last days
+// days. A backup is only deleted when both rules allow it, so with both set the newest n are kept
+// however old they are. A rule given as 0 keeps nothing by itself. With dryRun the files are only
+// listed.
+func pruneBackups(lg *log.Logger, distro string, n, days int, dryRun bool) error {
+	sets, err := distroBackups(distro)
+	if err != nil {
+		return fmt.Errorf("error scanning for old backups: %v", err)
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -days)
+	for i, bs := range sets {
+		keep := i < n || (days > 0 && bs.name.time.After(cutoff))
+		for _, f := range bs.files {
+			switch {
+			case keep && dryRun:
+				lg.Printf("Would keep:   %s\n", f)
+			case keep:
+			case dryRun:
+				lg.Printf("Would delete: %s\n", f)
+			default:
+				lg.Printf("Deleting old backup %s...\n", f)
+				if err := os.Remove(f); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// forgetDistro deletes every backup of distro in -dir along with the files that go with them, for
+// retiring a distribution. The files are listed and confirmation is asked for first unless assumeYes
+// is set.
+func forgetDistro(distro string, assumeYes bool) error {
+	sets, err := distroBackups(distro)
+	if err != nil {
+		return fmt.Errorf("error scanning for backups: %v", err)
+	}
+
+	var files []string
+	for _, bs := range sets {
+		files = append(files, bs.files...)
+	}
+
+	if len(files) == 0 {
+		log.Printf("No backups of %s found in %s.\n", distro, backupDir())
+		return nil
+	}
+
+	for _, f := range files {
+		fmt.Println(f)
+	}
+
+	if !assumeYes {
+		ok, err := confirm(fmt.Sprintf("Delete these %d files of %s?", len(files), distro))
+		if err != nil {
+			return fmt.Errorf("not deleting anything: %v", err)
+		}
+		if !ok {
+			log.Println("Nothing deleted.")
+			return nil
+		}
+	}
+
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+	}
+	log.Printf("Deleted %d files of %s.\n", len(files), distro)
+
+	return nil
+}
+
+// confirm asks the user the yes or no question q, returning true only if they answer yes. It fails
+// when there is nobody to ask.
+func confirm(q string) (bool, error) {
+	if !interactive() {
+		return false, errors.New("no confirmation without a console, use -yes from a script")
+	}
+
+	fmt.Printf("%s [y/N]: ", q)
+	in := bufio.NewScanner(os.Stdin)
+	return in.Scan() && strings.EqualFold(strings.TrimSpace(in.Text()), "y"), nil
+}
+
+// previewPrune lists what -keep-last and -keep-days would keep and delete for -distro, or every
+// distribution with -all.
+func previewPrune() error {
+	distros := []string{fileDistro(*distro)}
+	if *all {
+		list, err := listDistros()
+		if err != nil {
+			return err
+		}
+
+		distros = nil
+		for _, d := range selectDistros(list) {
+			distros = append(distros, d.name)
+		}
+		if *bundle {
+			distros = append(distros, bundleDistro)
+		}
+	}
+
+	for _, d := range distros {
+		log.Printf("Backups of %s with -keep-last %d and -keep-days %d:\n", d, *keeplast, *keepdays)
+		if err := pruneBackups(log.Default(), d, *keeplast, *keepdays, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dedupeBackup replaces the new backup fn of distro with a hard link to the most recent earlier backup
+// of the same type if the two are byte for byte identical, so a distribution that didn't change
+// between runs takes no more disk space.
+func dedupeBackup(lg *log.Logger, distro, fn string) error {
+	bn, ok := parseBackupName(fn)
+	if !ok {
+		return nil
+	}
+
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+
+	sets, err := distroBackups(distro)
+	if err != nil {
+		return fmt.Errorf("error scanning for old backups: %v", err)
+	}
+
+	// Find the newest earlier backup made the same way.
+	var prev string
+	for _, bs := range sets {
+		if !bn.newer(bs.name) {
+			continue
+		}
+		for _, f := range bs.files {
+			if pn, _ := parseBackupName(f); pn.format == bn.format && strings.EqualFold(pn.ext, bn.ext) {
+				prev = f
+			}
+		}
+		if prev != "" {
+			break
+		}
+	}
+
+	if prev == "" {
+		return nil
+	}
+
+	pfi, err := os.Stat(prev)
+	if err != nil || pfi.Size() != fi.Size() || os.SameFile(fi, pfi) {
+		return err
+	}
+
+	sum, err := checksumFile("sha256", fn)
+	if err != nil {
+		return err
+	}
+	psum, err := checksumFile("sha256", prev)
+	if err != nil || sum != psum {
+		return err
+	}
+
+	// Link under a temporary name first so fn is never missing.
+	tmp := partialName(fn)
+	if err := os.Link(prev, tmp); err != nil {
+		return fmt.Errorf("error linking to identical backup %s: %v", prev, err)
+	}
+	if err := os.Rename(tmp, fn); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	lg.Printf("Backup is identical to %s, replaced it with a hard link saving %d bytes.\n", prev, fi.Size())
+
+	return nil
+}
+
+// compressionName returns the -z format a backup with the extension ext was compressed with, "none" if
+// it is not compressed or false if ext is a sidecar file rather than a backup.
+func compressionName(ext string) (string, bool) {
+	if ext == "" {
+		return "none", true
+	}
+
+	for name, c := range compressors {
+		if strings.EqualFold(ext, c.ext) {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// storedBackup is a backup file found by scanBackups.
+type storedBackup struct {
+	name       backupName
+	path, comp string
+	size       int64
+}
+
+// scanBackups returns the backups in dir and the directories below it, grouped by distribution and
+// newest first.
+func scanBackups(dir string) ([]storedBackup, error) {
+	var list []storedBackup
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		bn, ok := parseBackupName(path)
+		if !ok || strings.Contains(d.Name(), ".partial.") {
+			return nil
+		}
+
+		comp, ok := compressionName(bn.ext)
+		if !ok {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		list = append(list, storedBackup{bn, path, comp, fi.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if a, b := strings.ToLower(list[i].name.distro), strings.ToLower(list[j].name.distro); a != b {
+			return a < b
+		}
+		return list[i].name.newer(list[j].name)
+	})
+
+	return list, nil
+}
+
+// listBackups prints a table of the backups in dir and the directories below it, grouped by
+// distribution and newest first.
+func listBackups(dir string) error {
+	list, err := scanBackups(dir)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DISTRO\tTIME\tFORMAT\tSIZE\tCOMPRESSION\tFILE")
+	for _, e := range list {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", e.name.distro, e.name.time.Format("2006-01-02 15:04"), e.name.format, e.size, e.comp, e.path)
+	}
+
+	return tw.Flush()
+}
+
+// storedBackupJSON is a backup in the -list-backups-json output.
+type storedBackupJSON struct {
+	Path        string    `json:"path"`
+	Time        time.Time `json:"time"`
+	Size        int64     `json:"size"`
+	Format      string    `json:"format"`
+	Compression string    `json:"compression"`
+	SHA256      string    `json:"sha256,omitempty"`
+}
+
+// distroBackupsJSON is the backups of one distribution in the -list-backups-json output.
+type distroBackupsJSON struct {
+	Distro  string             `json:"distro"`
+	Backups []storedBackupJSON `json:"backups"`
+}
+
+// sidecarSHA256 returns the SHA-256 of the backup file fn recorded by -checksum or -manifest, or "" if
+// there isn't one.
+func sidecarSHA256(fn string) string {
+	if b, err := os.ReadFile(fn + ".sha256"); err == nil {
+		if f := strings.Fields(string(b)); len(f) > 0 {
+			return f[0]
+		}
+	}
+
+	b, err := os.ReadFile(uncompressedName(fn) + ".manifest.json")
+	if err != nil {
+		return ""
+	}
+
+	var m map[string]interface{}
+	if json.Unmarshal(b, &m) != nil || m["file"] != filepath.Base(fn) {
+		return ""
+	}
+
+	sum, _ := m["artifact_sha256"].(string)
+	return sum
+}
+
+// listBackupsJSON prints the backups in dir and the directories below it as JSON, grouped by
+// distribution and newest first.
+func listBackupsJSON(dir string) error {
+	list, err := scanBackups(dir)
+	if err != nil {
+		return err
+	}
+
+	groups := []distroBackupsJSON{}
+	for _, e := range list {
+		if n := len(groups); n == 0 || !strings.EqualFold(groups[n-1].Distro, e.name.distro) {
+			groups = append(groups, distroBackupsJSON{Distro: e.name.distro})
+		}
+
+		g := &groups[len(groups)-1]
+		g.Backups = append(g.Backups, storedBackupJSON{
+			Path:        e.path,
+			Time:        e.name.time,
+			Size:        e.size,
+			Format:      e.name.format,
+			Compression: e.comp,
+			SHA256:      sidecarSHA256(e.path),
+		})
+	}
+
+	b, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Printf("%s\n", b)
+	return err
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/text/encoding/unicode"
+)
+
+// sampleList is "wsl -l -v" output used to check decoding and parsing without a real distribution.
+const sampleList = "  NAME            STATE           VERSION\r\n* Ubuntu          Running         2\r\n  kali-linux      Stopped         2\r\n"
+
+// selfTest checks each capability a backup relies on and prints whether it works, returning false if
+// any failed. No distribution is touched.
+func selfTest() bool {
+	checks := []struct {
+		name string
+		fn   func() error
+	}{
+		{"invoke wsl", testInvoke},
+		{"decode UTF-16 output", testDecode},
+		{"parse distribution list", testParse},
+		{"write and zip a file", testZip},
+		{"checksum and manifest", testChecksum},
+	}
+
+	ok := true
+	for _, c := range checks {
+		if err := c.fn(); err != nil {
+			fmt.Printf("%-26s FAILED: %v\n", c.name, err)
+			ok = false
+			continue
+		}
+		fmt.Printf("%-26s OK\n", c.name)
+	}
+
+	return ok
+}
+
+// testInvoke checks wsl can be found and run.
+func testInvoke() error {
+	if _, err := exec.LookPath(wsl); err != nil {
+		return err
+	}
+
+	_, err := wslCmd("--status")
+	return err
+}
+
+// testDecode checks UTF-16 output from wsl is decoded correctly.
+func testDecode() error {
+	enc, err := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewEncoder().String(sampleList)
+	if err != nil {
+		return err
+	}
+
+	dec, err := fromUTF16([]byte(enc))
+	if err != nil {
+		return err
+	}
+
+	if string(dec) != sampleList {
+		return fmt.Errorf("decoded %q, want %q", dec, sampleList)
+	}
+
+	return nil
+}
+
+// testParse checks the distribution list is parsed correctly.
+func testParse() error {
+	got := parseDistros(sampleList)
+	want := []distroInfo{{"Ubuntu", "Running", "2", true}, {"kali-linux", "Stopped", "2", false}}
+	if len(got) != len(want) {
+		return fmt.Errorf("parsed %d distributions, want %d", len(got), len(want))
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			return fmt.Errorf("parsed %+v, want %+v", got[i], want[i])
+		}
+	}
+
+	return nil
+}
+
+// testZip writes a small dummy file, compresses it to a ZIP file and reads it back.
+func testZip() error {
+	dir, err := os.MkdirTemp("", "wsl2backup-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("wsl2backup selftest\n"), 4096)
+	fn := filepath.Join(dir, "selftest.tar")
+	if err := os.WriteFile(fn, data, 0644); err != nil {
+		return err
+	}
+
+	if err := compressFile(log.New(io.Discard, "", 0), compressors["zip"], fn, fn+".zip", filepath.Base(fn), nil); err != nil {
+		return err
+	}
+
+	zr, err := zip.OpenReader(fn + ".zip")
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	if len(zr.File) != 1 {
+		return fmt.Errorf("zip has %d files, want 1", len(zr.File))
+	}
+
+	rc, err := zr.File[0].Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(got, data) {
+		return errors.New("zip contents do not match the original file")
+	}
+
+	return nil
+}
+
+// testChecksum writes a checksum and manifest for a small dummy file and checks them against it, then
+// changes a byte of the file and checks that both notice.
+func testChecksum() error {
+	dir, err := os.MkdirTemp("", "wsl2backup-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("wsl2backup selftest\n"), 4096)
+	fn := filepath.Join(dir, "selftest.tar")
+	if err := os.WriteFile(fn, data, 0644); err != nil {
+		return err
+	}
+
+	cf, err := writeChecksum(*sumalgo, fn, fn)
+	if err != nil {
+		return err
+	}
+	mf := fn + ".manifest.json"
+	if err := writeManifest("selftest", "tar", *sumalgo, fn, fn, mf, "", 0); err != nil {
+		return err
+	}
+
+	// sumMatches returns whether the checksum file still matches fn.
+	sumMatches := func() (bool, error) {
+		b, err := os.ReadFile(cf)
+		if err != nil {
+			return false, err
+		}
+		want, _, _ := strings.Cut(string(b), " ")
+
+		sum, err := checksumFile(*sumalgo, fn)
+		return sum == want, err
+	}
+
+	if ok, err := sumMatches(); err != nil {
+		return err
+	} else if !ok {
+		return errors.New("checksum file does not match the original file")
+	}
+	if _, _, problems, err := checkManifest(mf); err != nil {
+		return err
+	} else if len(problems) > 0 {
+		return fmt.Errorf("manifest does not match the original file: %s", strings.Join(problems, ", "))
+	}
+
+	data[len(data)/2] ^= 1
+	if err := os.WriteFile(fn, data, 0644); err != nil {
+		return err
+	}
+
+	if ok, err := sumMatches(); err != nil {
+		return err
+	} else if ok {
+		return errors.New("checksum file still matches a changed file")
+	}
+	if _, _, problems, err := checkManifest(mf); err != nil {
+		return err
+	} else if len(problems) == 0 {
+		return errors.New("manifest still matches a changed file")
+	}
+
+	return nil
+}
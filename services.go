@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// serviceCtl runs "systemctl action" on the services svcs in distro as root, or on the user services
+// of -run-as-user as that user.
+func serviceCtl(lg *log.Logger, distro, action string, svcs []string) error {
+	args := []string{"-d", distro, "-u", "root", "--exec", "systemctl", action}
+	if *runas != "" {
+		uid, err := userID(distro, *runas)
+		if err != nil {
+			return err
+		}
+
+		// wsl --exec doesn't log the user in, so point systemctl at their instance of systemd.
+		args = []string{"-d", distro, "-u", *runas, "--exec", "env", fmt.Sprintf("XDG_RUNTIME_DIR=/run/user/%d", uid), "systemctl", "--user", action}
+		lg.Printf("Running systemctl --user %s %s as %s in %s...\n", action, strings.Join(svcs, " "), *runas, distro)
+	} else {
+		lg.Printf("Running systemctl %s %s in %s...\n", action, strings.Join(svcs, " "), distro)
+	}
+
+	args = append(args, svcs...)
+	if out, err := exec.Command(wsl, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("error running systemctl %s in %s: %v: %s", action, distro, err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
+
+// stopServices stops the -stop-services in distro so they write out their data, then terminates distro
+// so it can be exported. The sequence around a backup is:
+//
+//  1. stop the -stop-services, starting distro first if needed
+//  2. terminate distro
+//  3. export
+//  4. start distro and the -start-services once the export is validated, even if it failed
+func stopServices(lg *log.Logger, distro string) error {
+	if err := serviceCtl(lg, distro, "stop", *stopsvcs); err != nil {
+		return err
+	}
+
+	if _, err := wslCmd("--terminate " + distro); err != nil {
+		return fmt.Errorf("error terminating %s: %v", distro, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
+	"github.com/skip2/go-qrcode"
+)
+
+// shareQRSize is the width in pixels of the PNG written by -share-qr png.
+const shareQRSize = 512
+
+// shareBlob logs a read-only download URL for the blob name in container that expires after
+// -share-expiry, showing it as a QR code too if -share-qr is set. fn is the local backup the blob
+// was uploaded from. Signing the URL needs the account key from a connection string.
+func shareBlob(lg *log.Logger, client *azblob.Client, container, name, fn string) error {
+	expiry := time.Now().Add(*shareexp).UTC()
+	u, err := client.ServiceClient().NewContainerClient(container).NewBlobClient(name).GetSASURL(sas.BlobPermissions{Read: true}, expiry, nil)
+	if err != nil {
+		return fmt.Errorf("error signing a download URL, which needs %s: %v", azureConnEnv, err)
+	}
+	lg.Printf("Download URL, valid until %s: %s\n", expiry.Local().Format("2006-01-02 15:04"), u)
+
+	if *shareqr == "" {
+		return nil
+	}
+
+	q, err := qrcode.New(u, qrcode.Medium)
+	if err != nil {
+		return fmt.Errorf("error making QR code of the download URL: %v", err)
+	}
+
+	// Drawn on stderr with the log so stdout stays free for -summary-json.
+	if *shareqr == "terminal" {
+		fmt.Fprint(os.Stderr, q.ToSmallString(false))
+		return nil
+	}
+
+	png := fn + ".share.png"
+	if err := q.WriteFile(shareQRSize, png); err != nil {
+		return fmt.Errorf("error writing QR code: %v", err)
+	}
+	lg.Printf("QR code of the download URL written to %s.\n", png)
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// resultJSON is the machine readable form of a result.
+type resultJSON struct {
+	RunID    string  `json:"run_id"`
+	Distro   string  `json:"distro"`
+	Result   string  `json:"result"`
+	File     string  `json:"file,omitempty"`
+	Size     int64   `json:"size"`
+	Saved    int64   `json:"compact_saved,omitempty"`
+	Duration float64 `json:"duration_seconds"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// toJSON returns r in its machine readable form.
+func (r result) toJSON() resultJSON {
+	j := resultJSON{
+		RunID:    runID,
+		Distro:   r.distro,
+		Result:   "success",
+		File:     r.file,
+		Size:     r.size,
+		Saved:    r.saved,
+		Duration: r.duration.Seconds(),
+	}
+
+	switch {
+	case r.skipped():
+		j.Result = "skipped"
+		j.Error = r.err.Error()
+	case r.err != nil:
+		j.Result = "failure"
+		j.Error = r.err.Error()
+	}
+
+	return j
+}
+
+// runStatus is the JSON written to -status-file.
+type runStatus struct {
+	RunID   string       `json:"run_id"`
+	Time    time.Time    `json:"time"`
+	Success bool         `json:"success"`
+	Results []resultJSON `json:"results"`
+}
+
+// newRunStatus returns the status of a run with results.
+func newRunStatus(results []result) runStatus {
+	st := runStatus{RunID: runID, Time: time.Now(), Success: true}
+	for _, r := range results {
+		st.Results = append(st.Results, r.toJSON())
+		if r.err != nil && !r.skipped() {
+			st.Success = false
+		}
+	}
+
+	return st
+}
+
+// writeStatus writes the results of the run to fn, replacing it atomically.
+func writeStatus(fn string, results []result) error {
+	st := newRunStatus(results)
+	b, err := json.MarshalIndent(&st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeAtomic(fn, b)
+}
+
+// printSummary writes the results of the run to stdout as a single JSON object on one line, for the
+// next command in a pipeline to read. Everything else wsl2backup prints goes to stderr.
+func printSummary(results []result) error {
+	st := newRunStatus(results)
+	return json.NewEncoder(os.Stdout).Encode(&st)
+}
+
+// writeAtomic writes b to fn. It is written to a temporary file in the same directory and renamed
+// over fn so a reader never sees a partial file.
+func writeAtomic(fn string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fn), filepath.Base(fn)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fn)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// streamMagic starts a stream written with -stdout-header. It is followed by the length of the JSON
+// streamHeader as a big-endian uint32, the header, and then the export.
+var streamMagic = []byte("WSL2BKUP")
+
+// streamMaxHeader is the longest streamHeader readStreamHeader accepts.
+const streamMaxHeader = 64 << 10
+
+// streamHeader describes the export following it in a -stdout-header stream. The size of the export
+// isn't known until it has all been streamed, so it isn't included.
+type streamHeader struct {
+	RunID  string    `json:"run_id"`
+	Distro string    `json:"distro"`
+	Time   time.Time `json:"time"`
+	Format string    `json:"format"`
+	File   string    `json:"file"`
+}
+
+// writeStreamHeader writes the -stdout-header for h to w.
+func writeStreamHeader(w io.Writer, h streamHeader) error {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(b)))
+	_, err = w.Write(append(append(append([]byte{}, streamMagic...), n[:]...), b...))
+	return err
+}
+
+// readStreamHeader reads the -stdout-header at the start of r, or returns false if r doesn't start
+// with one, in which case nothing is consumed.
+func readStreamHeader(r *bufio.Reader) (streamHeader, bool, error) {
+	var h streamHeader
+	if b, err := r.Peek(len(streamMagic)); err != nil || !bytes.Equal(b, streamMagic) {
+		return h, false, nil
+	}
+	r.Discard(len(streamMagic))
+
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return h, true, fmt.Errorf("error reading stream header: %v", err)
+	}
+	if n > streamMaxHeader {
+		return h, true, fmt.Errorf("stream header of %d bytes is too long", n)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return h, true, fmt.Errorf("error reading stream header: %v", err)
+	}
+
+	return h, true, json.Unmarshal(b, &h)
+}
+
+// extractStream writes the export in fn, saved from -stdout with -stdout-header, into dir and returns
+// the extracted filename. It returns false if fn doesn't start with a header.
+func extractStream(fn, dir string) (string, bool, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	h, ok, err := readStreamHeader(r)
+	if !ok || err != nil {
+		return "", ok, err
+	}
+	if h.Format != "tar" {
+		return "", true, fmt.Errorf("%s holds a %q export, only tar exports are streamed", fn, h.Format)
+	}
+
+	out := filepath.Join(dir, "wsl2backup-restore-"+filepath.Base(h.File))
+	log.Printf("%s is a %s export of %s streamed at %s, extracting it to %s...\n", fn, h.Format, h.Distro, h.Time.Local().Format("2006-01-02 15:04"), out)
+
+	o, err := os.Create(out)
+	if err != nil {
+		return "", true, err
+	}
+
+	if _, err := io.Copy(o, r); err != nil {
+		o.Close()
+		os.Remove(out)
+		return "", true, fmt.Errorf("error extracting %s: %v", fn, err)
+	}
+
+	return out, true, o.Close()
+}
+
+// streamExport writes a tar export of distro to stdout for another program to archive, checksumming
+// it with -checksum-algo on the way. Once the export is complete the checksum is written in the
+// format of sha256sum to sumfn, or to stderr if sumfn is empty, so the receiving end can check what
+// it got. The checksum doesn't cover the -stdout-header. Nothing is written to disk.
+func streamExport(distro, sumfn string) error {
+	ok, err := distroCheck(log.Default(), distro)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("distro %q not found in WSL, check installed distribution with \"%s %s\"", distro, wsl, wslList)
+	}
+
+	name := outputName("tar", distro)
+	log.Printf("Exporting distribution %q to stdout as %s...\n", distro, name)
+
+	if *stdhdr {
+		if err := writeStreamHeader(os.Stdout, streamHeader{runID, distro, runStart, "tar", name}); err != nil {
+			return err
+		}
+	}
+
+	h := checksumAlgos[*sumalgo].new()
+	p := newProgress("export", name, 0)
+	err = runExport(log.Default(), exportCmd(distro), io.MultiWriter(os.Stdout, h, p))
+	if distroTar() {
+		if _, err := wslCmd("--terminate " + distro); err != nil {
+			log.Printf("Warning: error terminating %s: %v", distro, err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	p.finish()
+
+	line := fmt.Sprintf("%s  %s\n", hex.EncodeToString(h.Sum(nil)), name)
+	if sumfn == "" {
+		_, err := os.Stderr.WriteString(line)
+		return err
+	}
+
+	if err := writeAtomic(sumfn, []byte(line)); err != nil {
+		return fmt.Errorf("error writing checksum: %v", err)
+	}
+	log.Printf("Export complete, %s checksum written to %s.\n", *sumalgo, sumfn)
+
+	return nil
+}
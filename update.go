@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// wslReleases is the GitHub API URL of the latest WSL release, which "wsl --update" installs.
+const wslReleases = "https://api.github.com/repos/microsoft/WSL/releases/latest"
+
+// latestWSL returns the version of the latest WSL release.
+func latestWSL() (string, error) {
+	c := &http.Client{Timeout: 10 * time.Second}
+	resp, err := c.Get(wslReleases)
+	if err != nil {
+		return "", fmt.Errorf("error looking up the latest WSL release: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("looking up the latest WSL release returned %s", resp.Status)
+	}
+
+	var rel struct {
+		Tag string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&rel); err != nil {
+		return "", fmt.Errorf("error reading the latest WSL release: %v", err)
+	}
+
+	v := strings.TrimPrefix(rel.Tag, "v")
+	if v == "" {
+		return "", errors.New("the latest WSL release has no version")
+	}
+
+	return v, nil
+}
+
+// updateCheck logs a warning if the installed WSL is older than the latest release, or than
+// recommendedWSL if the latest release can't be looked up.
+func updateCheck() {
+	v, err := wslVersion()
+	if err != nil {
+		log.Printf("Warning: could not determine the WSL version (%v), this usually means the outdated inbox WSL is installed. Run \"%s --update\".\n", err, wsl)
+		return
+	}
+
+	latest, err := latestWSL()
+	if err != nil {
+		log.Printf("Warning: %v, checking against WSL %s instead.\n", err, recommendedWSL)
+		latest = recommendedWSL
+	}
+
+	if compareVersions(v, latest) < 0 {
+		log.Printf("Warning: WSL %s is outdated and may produce failed exports, %s is available. Run \"%s --update\".\n", v, latest, wsl)
+		return
+	}
+
+	log.Printf("WSL %s is up to date.\n", v)
+}
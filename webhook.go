@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// webhookPayload is the JSON posted to -webhook. Text and Content carry a human readable summary for
+// Slack/Teams and Discord incoming webhooks respectively, which ignore the other fields.
+type webhookPayload struct {
+	resultJSON
+	Text    string `json:"text"`
+	Content string `json:"content"`
+}
+
+// resultText is a one line human readable summary of r.
+func resultText(r result) string {
+	s := fmt.Sprintf("backup of %s succeeded, %s (%d bytes) in %v.", r.distro, r.file, r.size, r.duration.Round(time.Second))
+	switch {
+	case r.skipped():
+		s = fmt.Sprintf("backup of %s skipped: %v", r.distro, r.err)
+	case r.err != nil:
+		s = fmt.Sprintf("backup of %s FAILED after %v: %v", r.distro, r.duration.Round(time.Second), r.err)
+	}
+
+	return s + fmt.Sprintf(" (run %s)", runID)
+}
+
+// postWebhook posts the result of a backup to url.
+func postWebhook(url string, r result) error {
+	p := webhookPayload{resultJSON: r.toJSON()}
+	p.Text = "wsl2backup: " + resultText(r)
+	p.Content = p.Text
+
+	b, err := json.Marshal(&p)
+	if err != nil {
+		return err
+	}
+
+	c := &http.Client{Timeout: 30 * time.Second}
+	resp, err := c.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("error posting to webhook: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
@@ -2,15 +2,27 @@
 package main
 
 import (
-	"archive/zip"
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/text/encoding/unicode"
@@ -18,30 +30,239 @@ import (
 )
 
 var (
-	distro  = flag.String("distro", "kali-linux", "The WSL distribution to backup.")
-	outfile = flag.String("o", "", "Output filename, if not supplied it will be created using todays date, the distrbution name and the output type.")
-	outfmt  = flag.String("f", "vhdx", "Export output type. Valid are \"tar\" and \"vhdx\" (default)")
-	outzip  = flag.Bool("z", false, "Compress final output file using ZIP (default off).")
-	term    = flag.Bool("s", false, "Shutdown WSL if it is running in order to back it up.")
-	compact = flag.Bool("c", false, "Use Windows compact to compress the file output, this uses the built in NTFS compression instead of needing to unzip the file.")
-	keep    = flag.Bool("keep", false, "Keep the uncompressed file after compression. Only valid with the -z flag.")
+	distro   = flag.String("distro", "kali-linux", "The WSL distribution to backup.")
+	outfile  = flag.String("o", "", "Output filename, if not supplied it will be created using todays date, the distrbution name and the output type.")
+	outfmt   = flag.String("f", "vhdx", "Export output type. Valid are \"tar\" and \"vhdx\" (default)")
+	outzip   = compressVar("z", "Compress final output file using ZIP (default off). Use -z=gzip for parallel gzip compression, -z=lz4 for fast lz4 compression, -z=zstd for parallel zstd compression or -z=brotli for brotli compression that web browsers can decompress instead.")
+	term     = flag.Bool("s", false, "Shutdown WSL if it is running in order to back it up.")
+	compact  = flag.Bool("c", false, "Use Windows compact to compress the file output, this uses the built in NTFS compression instead of needing to unzip the file.")
+	outdir   = flag.String("dir", "", "Directory to write backups to, defaults to the current directory.")
+	zipdir   = flag.String("compressed-dir", "", "Directory to write the ZIP file to with -z, defaults to alongside the export.")
+	datepart = flag.Bool("partition", false, "Write backups into year/month/day subdirectories of -dir based on the current date.")
+	all      = flag.Bool("all", false, "Backup every installed WSL distribution instead of just -distro.")
+	parallel = flag.Int("parallel", 1, "Number of distributions to backup at once in -all mode.")
+	keep     = flag.Bool("keep", false, "Keep the uncompressed file after compression. Only valid with the -z flag.")
+	noatom   = flag.Bool("no-atomic", false, "Write the backup directly to its final name instead of a .partial name that is renamed once the backup completes.")
+	symscan  = flag.Bool("scan-symlinks", false, "After a tar export, scan the distribution for absolute symlinks that may not restore well on another machine (informational only).")
+	gens     = flag.Int("generations", 0, "Name backups as rolling generations, e.g. kali-linux.001.vhdx, rotating back to 001 after N generations instead of using a timestamp.")
+	chkupd   = flag.Bool("check-update", false, "Check the installed WSL version against the latest WSL release on GitHub before the backup and warn if it is outdated.")
+	inspect  = flag.String("inspect", "", "Print a summary of the contents of an existing backup file (tar, vhdx, zip or gz) and exit. Does not need WSL.")
+	saveconf = flag.Bool("conf", false, "Save the distribution's /etc/wsl.conf and /etc/fstab as text files alongside the backup.")
+	savewslc = flag.Bool("wslconfig", false, "Save %UserProfile%\\.wslconfig alongside the backup, or put it back with -restore.")
+	savereg  = flag.Bool("registry", false, "Save the registry settings WSL keeps for the distribution, such as the default user, to a .registry.json file alongside the backup. -restore puts them back, except those describing where it was installed.")
+	vhdcheck = flag.Bool("verify-vhd", false, "Verify the structure of vhdx exports with the Hyper-V Test-VHD PowerShell cmdlet, skipped if Hyper-V is not installed.")
+	vhdfall  = flag.Bool("vhd-fallback", false, "Fall back to a tar export if this WSL does not support vhdx exports.")
+	webhook  = flag.String("webhook", "", "URL of a Slack, Teams or Discord incoming webhook to POST the backup result to as JSON.")
+	hookfail = flag.Bool("webhook-on-failure-only", false, "Only POST to -webhook when the backup fails.")
+	restore  = flag.String("restore", "", "Restore a backup file (tar, vhdx or a ZIP, gzip, lz4, zstd or brotli of either) by importing it as a new distribution and exit. From a -bundle file the backup of -distro is restored.")
+	rname    = flag.String("name", "", "Name of the distribution to create with -restore, defaults to -distro.")
+	instdir  = flag.String("install-dir", "", "Directory to install the distribution restored with -restore in.")
+	defuser  = flag.String("default-user", "", "Default user to set on the distribution after -restore. If not set, the user saved with -registry is used when available.")
+	encoding = flag.String("encoding", "utf16le", "Encoding of wsl command output: \"utf16le\" (default), \"utf8\" or \"auto\" to detect it.")
+	keeplast = flag.Int("keep-last", 0, "After a successful backup, delete all but the N most recent timestamped backups of the distribution in -dir.")
+	keepdays = flag.Int("keep-days", 0, "After a successful backup, delete timestamped backups of the distribution in -dir older than this many days. With -keep-last the newest N are kept however old they are.")
+	prunepre = flag.Bool("prune-preview", false, "List the backups -keep-last and -keep-days would keep and delete, without deleting anything or making a backup, and exit.")
+	selftest = flag.Bool("selftest", false, "Check that this machine can run backups, without touching any distribution, and exit.")
+	gzblock  = flag.Int("gzip-block", 1024, "Block size in KB for parallel gzip compression with -z=gzip.")
+	gzprocs  = flag.Int("gzip-blocks", runtime.GOMAXPROCS(0), "Number of blocks to compress in parallel with -z=gzip.")
+	bootpre  = flag.Bool("boot-before", false, "Boot the distribution and let it settle before terminating it and exporting, so first boot initialization of rarely used distributions completes.")
+	bootwait = flag.Duration("boot-wait", 10*time.Second, "How long to let the distribution run with -boot-before.")
+	statusf  = flag.String("status-file", "", "Write the result of the run as JSON to this file at the end of every run, replacing it atomically, for monitoring agents to poll.")
+	excludes = listVar("exclude-path", "Path to leave out of a tar export, e.g. /var/cache. May be repeated. Only works with -f tar since the export is made by running tar inside the distribution instead of \"wsl --export\".")
+	keeptime = flag.Bool("preserve-timestamps", false, "Set the modification time of the backup files to when the run started, matching the timestamp in their names.")
+	termonly = flag.Bool("terminate-only", false, "Terminate -distro if it is running, without making a backup, and exit.")
+	manifest = flag.Bool("manifest", false, "Write a manifest with the checksums of the backup file and of the uncompressed export to <backup>.manifest.json.")
+	metricsf = flag.String("metrics-file", "", "Write Prometheus metrics for the run to this file, e.g. in the node_exporter textfile collector directory. Metrics of other distributions already in the file are kept.")
+	failfast = flag.Bool("fail-fast", false, "With -all, stop backing up further distributions after the first failure instead of continuing with the rest.")
+	componly = flag.String("compress-only", "", "Compress this existing backup file with -z or -c, without exporting anything, and exit. The file is deleted afterwards unless -keep is set.")
+	listdir  = flag.String("list-backups", "", "List the backups in this directory and those below it, by distribution and newest first, and exit.")
+	dedupe   = flag.Bool("dedupe", false, "If the backup is identical to the previous backup of the distribution, replace it with a hard link to the previous one to save space.")
+	nocolor  = flag.Bool("no-color", false, "Don't color success and failure messages, which is otherwise done when logging to a terminal.")
+	cpus     = flag.Int("cpus", 0, "Limit compression to this many CPU cores so backups don't slow down other work. 0 uses all of them.")
+	chkmount = flag.Bool("check-mount", false, "Before exporting, check the drive the backup goes to is connected and writable, failing early if it isn't.")
+	progress = flag.String("progress-file", "", "Write progress of the export and compression as JSON lines to this file, or \"-\" for stdout, for GUIs to follow. Logs stay on stderr.")
+	minwsl   = flag.String("min-wsl-version", "", "Refuse to run if the installed WSL is older than this version, e.g. \"2.0.14\".")
+	bundle   = flag.Bool("bundle", false, "With -all, put every distribution's export and the files that go with it into a single ZIP file instead of one file each. -restore takes the backup of -distro out of it.")
+	checksum = flag.Bool("checksum", false, "Write the checksum of the backup to <backup>.sha256, or the extension of -checksum-algo, in the format of sha256sum.")
+	sumalgo  = flag.String("checksum-algo", "sha256", "Checksum algorithm for -checksum and -manifest: \"sha256\" (default), \"sha512\" or \"blake3\", which is much faster on large backups.")
+	verifcmd = flag.String("verify-cmd", "", "Command to check the finished backup with, with double quotes around arguments containing spaces, run with the backup file as its last argument and in $WSL2BACKUP_VERIFY_FILE, and the distribution in $WSL2BACKUP_VERIFY_DISTRO. A non-zero exit fails the backup.")
+	zipmeth  = flag.String("zip-method", "auto", "How files are stored in ZIP files: \"deflate\" to compress them, \"store\" not to, or \"auto\" (default) to store vhdx files, which barely compress, and deflate tar files.")
+	diskuse  = flag.Bool("disk-usage", false, "Save a report of the disk usage of directories in the distribution, from du, to <backup>.du.txt.")
+	dudepth  = flag.Int("du-depth", 2, "How many directory levels deep the -disk-usage report goes.")
+	skiprun  = flag.Bool("skip-if-running", false, "Skip the backup and exit 0 if the distribution is running, instead of failing with exit code 3. -s shuts it down instead.")
+	quietskp = flag.Bool("quiet-on-skip", false, "When every distribution is skipped by -skip-if-running, log a single line instead of the whole run. The log is written as usual once a backup gets under way.")
+	resticr  = flag.String("restic-repo", "", "Stream a tar export (-f tar) into a snapshot in this restic repository instead of writing a file, tagged with the distribution and the time of the backup, e.g. 202401311200. The password is read by restic from RESTIC_PASSWORD or RESTIC_PASSWORD_FILE.")
+	listjson = flag.String("list-backups-json", "", "Like -list-backups but print the backups as JSON, including their SHA-256 when a -checksum or -manifest file has it.")
+	azure    = flag.String("azure-container", "", "Upload the backup to this Azure Blob Storage container, using the connection string in AZURE_STORAGE_CONNECTION_STRING or the SAS URL in AZURE_STORAGE_SAS_URL.")
+	azdelete = flag.Bool("azure-delete-local", false, "Delete the local backup file once it has been uploaded to -azure-container and its size checked.")
+	rscript  = flag.Bool("restore-script", false, "Write a PowerShell script next to the backup, <backup>.restore.ps1, that restores it with \"wsl --import\".")
+	health   = flag.Bool("health", false, "Print a summary of the WSL environment for troubleshooting, without making a backup, and exit.")
+	healthjs = flag.Bool("health-json", false, "Print the -health summary as JSON.")
+	metok    = flag.Bool("allow-metered", false, "Upload to -azure-container even when Windows reports the internet connection as metered.")
+	friendly = flag.String("friendly-name", "", "Name to use for the distribution in backup filenames instead of its registered name, e.g. \"dev-environment\".")
+	stopsvcs = listVar("stop-services", "Service to stop with systemctl before the distribution is terminated for the export, e.g. for a consistent database backup. May be repeated.")
+	startsvc = listVar("start-services", "Service to start with systemctl after the backup, whether it succeeded or not. May be repeated.")
+	runas    = flag.String("run-as-user", "", "Stop and start the -stop-services and -start-services as this user's systemd user services, with systemctl --user, instead of as root.")
+	overwrt  = flag.Bool("overwrite", false, "Replace a backup made earlier in the same minute instead of adding a ~1, ~2... counter to the new backup's name.")
+	trim     = flag.Bool("trim", false, "Before exporting, run fstrim in the distribution and make its virtual disk sparse so the space of deleted files is given back and the backup is smaller.")
+	zstdict  = flag.String("zstd-dict", "", "Compress -z=zstd backups using this zstd dictionary, made with -zstd-train. The -manifest records it so restoring finds it again.")
+	zstdtrn  = flag.String("zstd-train", "", "Train a zstd dictionary for -zstd-dict from the tar backups in -dir, write it to this file and exit.")
+	locked   = flag.Bool("detect-locked-files", false, "Before exporting, check no other process still has the distribution's disk open, naming the process and waiting up to -lock-wait for it to be released.")
+	lockwait = flag.Duration("lock-wait", 30*time.Second, "How long -detect-locked-files waits for the distribution's disk to be released before failing the backup.")
+	paths    = listVar("paths", "Only back up this directory of the distribution, e.g. /home, instead of its whole filesystem. May be repeated. Needs -f tar, and the backup holds just these files rather than a distribution that can be restored.")
+	bench    = flag.String("benchmark", "", "Compress this file with every -z compressor, each zstd level and compact, print how long each took and how big the result was, and exit. Nothing is kept.")
+	vmount   = flag.Bool("verify-mount", false, "Verify vhdx exports by mounting them read-only with \"wsl --mount\" and reading their root directory. Needs an elevated prompt.")
+	refdef   = flag.Bool("refresh-default", false, "Note the default distribution before the backup and set it back with \"wsl --set-default\" afterwards if shutting down or terminating WSL changed it.")
+	exclfrom = flag.String("exclude-from", "", "File of glob patterns to leave out of a tar export, one per line like a .gitignore file. Blank lines and # comments are skipped. Needs -f tar.")
+	report   = flag.String("report-html", "", "Write an HTML page summarizing the run and the backups in -dir to this file, for sharing the backup status.")
+	cancelf  = flag.String("cancel-file", "", "Cancel the backup, killing the export and removing its partial files, as soon as this file appears. For schedulers that can't send a signal.")
+	maxrun   = flag.Duration("max-runtime", 0, "Stop the whole run, cleaning up partial files, if it takes longer than this, e.g. \"2h\", exiting with code 4.")
+	shareurl = flag.Bool("share-url", false, "After uploading to -azure-container, log a read-only download URL for the backup that expires after -share-expiry. Needs AZURE_STORAGE_CONNECTION_STRING to sign it.")
+	shareexp = flag.Duration("share-expiry", time.Hour, "How long the -share-url download URL works for.")
+	shareqr  = flag.String("share-qr", "", "Also show the -share-url as a QR code: \"terminal\" to print it, or \"png\" to write it to <backup>.share.png.")
+	measure  = flag.Bool("measure", false, "Export -distro to a temporary file in -dir, print how big it is and how long it took, delete it and exit. For capacity planning.")
+	strict   = flag.Bool("strict", false, "With -restore, fail instead of warning when the backup's manifest shows it was made with a different major version of WSL.")
+	forget   = flag.String("forget-distro", "", "Delete every backup of this distribution in -dir, with its compressed copies and sidecar files, after listing them and asking for confirmation, and exit.")
+	yes      = flag.Bool("yes", false, "Don't ask for confirmation before -forget-distro deletes backups or -replace replaces a distribution, for scripts.")
+	verifman = flag.String("verify-manifest", "", "Check the backup described by this -manifest file, found next to it, still has the recorded size, format and checksum, print PASS or FAIL and exit. Does not need WSL.")
+	evlog    = flag.Bool("event-log", false, "Write the result of each backup to the Windows Application event log as source wsl2backup, with event ID 1 for success, 2 for failure and 3 when skipped. Registering the source needs an elevated prompt the first time.")
+	onepass  = flag.Bool("single-pass", false, "With -manifest and -z, checksum the export while compressing it instead of decompressing the backup again afterwards. Halves the reading for large backups but no longer proves the compressed file reads back.")
+	difflive = flag.String("diff-live", "", "List the files added (+), removed (-) and modified (M) in -distro since this tar backup was made, comparing sizes and modification times, and exit.")
+	memlimit = flag.String("mem-limit", "", "Keep the buffers used to compress and upload each backup within about this size, e.g. \"256MB\", using smaller blocks and fewer at once. Shared between backups run with -parallel.")
+	fsfreeze = flag.Bool("fsfreeze", false, "Back up a running distribution without terminating it by freezing its root filesystem with fsfreeze while its virtual disk is copied. Needs -f vhdx. Stopped distributions are exported as usual.")
+	summary  = flag.Bool("summary-json", false, "Print the result of the run to stdout as one JSON object, in the same form as -status-file, once every backup has finished. Logs go to stderr as always.")
+	tostdout = flag.Bool("stdout", false, "Stream a tar export (-f tar) of -distro to stdout instead of writing a file, for piping to a remote archive, and exit. The -checksum-algo checksum of the stream is written to -checksum-file once it is complete.")
+	stdhdr   = flag.Bool("stdout-header", false, "With -stdout, start the stream with the 8 bytes WSL2BKUP, the length of a JSON header as a 4 byte big-endian number, then the header, describing the distribution, format, file name and time of the export that follows. -restore reads files saved from such a stream.")
+	sumfile  = flag.String("checksum-file", "", "With -stdout, write the checksum of the stream to this file in the format of sha256sum. Written to stderr if not set.")
+	replace  = flag.Bool("replace", false, "With -restore, replace an existing distribution of the same -name, unregistering it and deleting everything in it once the backup has imported, after asking for confirmation or with -yes. Needs a different -install-dir to the existing distribution.")
+	level    = flag.Int("level", 6, "Compression quality for -z=brotli, from 0 (fastest) to 11 (smallest).")
+	match    = flag.String("match", "", "With -all, only back up distributions whose names match this regular expression, e.g. \"^prod-\".")
+	nomatch  = flag.String("exclude-match", "", "With -all, skip distributions whose names match this regular expression.")
+	vhdpath  = flag.String("vhd-path", "", "The virtual disk -distro runs from, for -detect-locked-files and -fsfreeze, instead of looking it up in the registry. For distributions whose ext4.vhdx has been moved.")
+	minsize  = flag.String("min-size", "", "Fail if the final backup file is smaller than this size, e.g. \"100MB\". Guards against near-empty exports.")
+	maxsize  = flag.String("max-size", "", "Warn if the final backup file is larger than this size, e.g. \"50GB\". Catches runaway logs or caches filling the distribution.")
+	maxfail  = flag.Bool("max-size-fail", false, "Fail instead of warning when the backup is larger than -max-size.")
+	cthresh  = flag.String("compress-threshold", "", "Skip compression (-z or -c) when the export is smaller than this size, e.g. \"500MB\".")
+
+	// Sizes parsed from the flags above.
+	minBytes, maxBytes, compressMin int64
+
+	// Patterns read from the -exclude-from file.
+	excludeGlobs []string
+
+	// Arguments given after -- on the command line, passed as they are to wsl --export.
+	exportArgs []string
+
+	// The compiled -match and -exclude-match expressions.
+	matchRE, noMatchRE *regexp.Regexp
 )
 
 const (
 	// WSL Commands.
 	wsl     = "wsl"
 	wslList = "-l -v"
+	wslVer  = "--version"
+
+	// Oldest WSL release considered current when the latest release can't be looked up, older builds
+	// had export bugs fixed by "wsl --update".
+	recommendedWSL = "2.0.0"
 
 	// Compact commands.
 	compactexe = "compact"
+
+	// PowerShell commands.
+	powershell = "powershell"
+	// testVHD exits 0 if the vhdx in $env:WSL2BACKUP_VHD is valid, 1 if it is not, 2 if the Hyper-V module is
+	// not installed and 3 if Test-VHD could not run.
+	testVHD = `if (-not (Get-Command Test-VHD -ErrorAction SilentlyContinue)) { exit 2 }
+try { if (Test-VHD -Path $env:WSL2BACKUP_VHD -ErrorAction Stop) { exit 0 } else { exit 1 } } catch { Write-Output $_.Exception.Message; exit 3 }`
+
+	// Event log source and event IDs for -event-log.
+	eventSource  = "wsl2backup"
+	eventSuccess = 1
+	eventFailure = 2
+	eventSkipped = 3
+
+	// How often -cancel-file is checked for.
+	cancelPoll = time.Second
+
+	// Exit codes.
+	exitTooSmall = 2
+	exitRunning  = 3
+	exitTimedOut = 4
+)
+
+// runStart is when this run started, used for naming backups so every file from the run agrees.
+var runStart = time.Now()
+
+// runCtx is cancelled when -cancel-file appears or -max-runtime runs out, killing the export and
+// stopping compression and uploads.
+var runCtx, cancelRun = context.WithCancel(context.Background())
+
+// phases is the step each distribution's backup is at, to log where -max-runtime ran out.
+var phases sync.Map
+
+// setPhase records that the backup of distro has reached phase.
+func setPhase(distro, phase string) {
+	phases.Store(distro, phase)
+}
+
+// cancelErr returns why the run was stopped early, or nil if it wasn't.
+func cancelErr() error {
+	switch runCtx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return errTimedOut
+	}
+
+	return errCancelled
+}
+
+// runID identifies this run in logs, manifests and notifications so they can be matched up.
+var runID = newRunID()
+
+// newRunID returns a random 8 character hex ID.
+func newRunID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return runStart.Format("150405.00")
+	}
+
+	return hex.EncodeToString(b)
+}
+
+var (
+	errTooSmall       = errors.New("backup is smaller than the minimum size")
+	errVHDUnsupported = errors.New("this WSL version or distribution does not support vhdx exports")
+	errSkipped        = errors.New("skipped after an earlier failure with -fail-fast")
+	errRunning        = errors.New("distribution is running")
+	errTooLarge       = errors.New("backup is larger than the maximum size")
+	errCancelled      = errors.New("backup cancelled with -cancel-file")
+	errTimedOut       = errors.New("backup stopped when -max-runtime ran out")
+	errMetered        = errors.New("upload skipped on a metered connection")
 )
 
 // wslCmd runs a WSL command with arguments "flags" and returns a slice of bytes containing
 // the stdout output in UTF8 encoding.
 func wslCmd(flags string) ([]byte, error) {
+	return wslCmdContext(context.Background(), flags)
+}
+
+// wslCmdContext is wslCmd with the command killed if ctx is done before it completes.
+func wslCmdContext(ctx context.Context, flags string) ([]byte, error) {
 	// TODO: Fix to properly process quoted arguments later.
-	args := strings.Split(flags, " ")
-	cmd := exec.Command(wsl, args...)
+	return wslArgsContext(ctx, strings.Split(flags, " ")...)
+}
+
+// wslArgs runs wsl with args, which unlike wslCmd may contain spaces such as in paths.
+func wslArgs(args ...string) ([]byte, error) {
+	return wslArgsContext(context.Background(), args...)
+}
+
+// wslArgsContext runs wsl with args, which unlike wslCmdContext may contain spaces.
+func wslArgsContext(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, wsl, args...)
 
 	// TODO: Also capture stderr.
 	stdout, err := cmd.StdoutPipe()
@@ -56,208 +277,2067 @@ func wslCmd(flags string) ([]byte, error) {
 		return nil, err
 	}
 	if err := cmd.Wait(); err != nil {
-		return result, err
+		// Decode what we can so error messages are readable.
+		out, _ := decodeOutput(result)
+		return out, err
+	}
+
+	return decodeOutput(result)
+}
+
+// decodeOutput returns wsl output in UTF8 according to -encoding. WSL normally writes UTF16 but some
+// configurations produce UTF8, which auto detects.
+func decodeOutput(b []byte) ([]byte, error) {
+	utf8bom := []byte{0xef, 0xbb, 0xbf}
+	switch *encoding {
+	case "utf8":
+		return bytes.TrimPrefix(b, utf8bom), nil
+	case "auto":
+		if !looksUTF16(b) {
+			return bytes.TrimPrefix(b, utf8bom), nil
+		}
+	}
+
+	return fromUTF16(b)
+}
+
+// looksUTF16 guesses whether b is UTF16 little endian text. It is if it starts with a UTF16 byte order
+// mark, otherwise since wsl output is mostly ASCII most characters should have a zero high byte. Odd
+// length output can't be UTF16 at all.
+func looksUTF16(b []byte) bool {
+	if bytes.HasPrefix(b, []byte{0xff, 0xfe}) {
+		return true
+	}
+
+	if len(b) == 0 || len(b)%2 != 0 {
+		return false
 	}
 
-	// Return UTF8 encoded from Windows UTF16.
+	var zeros int
+	for i := 1; i < len(b); i += 2 {
+		if b[i] == 0 {
+			zeros++
+		}
+	}
+
+	return zeros > len(b)/4
+}
+
+// fromUTF16 returns UTF8 encoded from Windows UTF16.
+func fromUTF16(b []byte) ([]byte, error) {
 	win16 := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
 	utf16bom := unicode.BOMOverride(win16.NewDecoder())
-	ur := transform.NewReader(bytes.NewReader(result), utf16bom)
+	ur := transform.NewReader(bytes.NewReader(b), utf16bom)
 	return io.ReadAll(ur)
 }
 
-// distroCheck returns true of distro is in the WSL distribution list, false if not or an error.
-func distroCheck(distro string) (bool, error) {
+// wslExec runs a command inside the distribution and returns its stdout. Unlike wslCmd the output
+// comes from Linux so it is already UTF8 and is returned as is.
+func wslExec(distro string, args ...string) ([]byte, error) {
+	cmd := exec.Command(wsl, append([]string{"-d", distro, "--exec"}, args...)...)
+	return cmd.Output()
+}
+
+// wslVersion returns the installed WSL version, e.g. "2.0.14.0". The inbox version of WSL shipped
+// with Windows does not support --version so an error here usually means WSL is very old.
+func wslVersion() (string, error) {
+	res, err := wslCmd(wslVer)
+	if err != nil {
+		return "", err
+	}
+
+	// The first line is "WSL version: x.y.z" but the label is localized, so just find the number.
+	line, _, _ := strings.Cut(strings.TrimSpace(string(res)), "\n")
+	if v := regexp.MustCompile(`\d+(\.\d+)+`).FindString(line); v != "" {
+		return v, nil
+	}
+
+	return "", fmt.Errorf("could not find a WSL version in %q", line)
+}
+
+// compareVersions compares dotted version strings a and b numerically and returns -1, 0 or 1.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// distroInfo describes a distribution as listed by "wsl -l -v".
+type distroInfo struct {
+	name, state, version string
+	isDefault            bool
+}
+
+// listDistros returns the installed WSL distributions.
+func listDistros() ([]distroInfo, error) {
 	res, err := wslCmd(wslList)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	type dinfo struct{ name, state, version string }
-	distros := strings.Split(string(res), "\r\n")
-	for i, d := range distros {
-		if i == 0 {
-			// Skip header.
-			continue
+	list := parseDistros(string(res))
+	if len(list) == 0 {
+		return nil, fmt.Errorf("\"%s %s\" did not list any distributions, is WSL installed and set up? It returned: %q", wsl, wslList, strings.TrimSpace(string(res)))
+	}
+
+	return list, nil
+}
+
+// defaultDistro returns the name of the default WSL distribution, or "" if there isn't one.
+func defaultDistro() (string, error) {
+	list, err := listDistros()
+	if err != nil {
+		return "", err
+	}
+
+	for _, d := range list {
+		if d.isDefault {
+			return d.name, nil
 		}
+	}
+
+	return "", nil
+}
+
+// restoreDefault makes name the default distribution again if it no longer is.
+func restoreDefault(name string) error {
+	cur, err := defaultDistro()
+	if err != nil {
+		return err
+	}
+
+	if cur == name {
+		return nil
+	}
+
+	log.Printf("The default distribution changed from %s to %q during the backup, setting it back.\n", name, cur)
+	_, err = wslCmd("--set-default " + name)
+	return err
+}
 
+// parseDistros parses the decoded output of "wsl -l -v". Rather than assuming the first line is the
+// header, which is localized and missing entirely from some odd outputs, only lines shaped like a
+// distribution are used: a name, a state and a numeric WSL version.
+func parseDistros(res string) []distroInfo {
+	var list []distroInfo
+	for _, d := range strings.Split(res, "\r\n") {
+		// The default distribution is marked with an asterisk.
+		isDefault := strings.Contains(d, "* ")
 		d = strings.Replace(d, "* ", "", -1)
 		fields := strings.Fields(d)
+		if len(fields) != 3 {
+			continue
+		}
 
-		nfo := &dinfo{}
-		if len(fields) == 3 {
-			nfo = &dinfo{fields[0], fields[1], fields[2]}
+		if _, err := strconv.Atoi(fields[2]); err != nil {
+			// Header line.
+			continue
 		}
 
-		// WSL command is not fussy about distro case, so we don't need to be either.
-		if strings.EqualFold(nfo.name, distro) {
-			if nfo.state == "Stopped" {
-				return true, nil
-			}
+		list = append(list, distroInfo{fields[0], fields[1], fields[2], isDefault})
+	}
 
-			if *term {
-				log.Printf("Found %v distro but it is running, shutting down WSL as requested...\n", nfo.name)
-				_, err = wslCmd("--shutdown")
-				if err != nil {
-					return false, err
-				}
+	return list
+}
 
-				// Check again now, recursively.
-				return distroCheck(distro)
-			}
+// stringList is a flag that may be repeated to build a list.
+type stringList []string
+
+// listVar defines a stringList flag with the given name and usage.
+func listVar(name, usage string) *stringList {
+	l := new(stringList)
+	flag.Var(l, name, usage)
+	return l
+}
 
-			return false, fmt.Errorf("found distribution %s but it is running and -s flag not specified so it will not be shutdown", nfo.name)
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// flagSet returns true if the named flag was given on the command line.
+func flagSet(name string) bool {
+	var set bool
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
+	})
+
+	return set
+}
+
+// interactive returns true if stdin is a terminal a user can answer questions on.
+func interactive() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// chooseDistro asks the user to pick one of the installed distributions from a numbered menu.
+func chooseDistro() (string, error) {
+	distros, err := listDistros()
+	if err != nil {
+		return "", err
+	}
+
+	if len(distros) == 0 {
+		return "", errors.New("no WSL distributions are installed")
 	}
 
-	return false, nil
+	fmt.Println("Installed WSL distributions:")
+	for i, d := range distros {
+		fmt.Printf("  %d) %s (%s, WSL %s)\n", i+1, d.name, d.state, d.version)
+	}
+
+	in := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Printf("Distribution to backup [1-%d]: ", len(distros))
+		if !in.Scan() {
+			return "", errors.New("no distribution chosen")
+		}
+
+		if n, err := strconv.Atoi(strings.TrimSpace(in.Text())); err == nil && n >= 1 && n <= len(distros) {
+			return distros[n-1].name, nil
+		}
+	}
 }
 
-func wslExport(distro, format, of string) error {
-	var fmtarg string
-	if format == "vhdx" {
-		fmtarg = " --vhd"
+// findDistro returns the installed distribution named distro, or false if there isn't one.
+func findDistro(distro string) (distroInfo, bool, error) {
+	distros, err := listDistros()
+	if err != nil {
+		return distroInfo{}, false, err
+	}
+
+	for _, nfo := range distros {
+		// WSL command is not fussy about distro case, so we don't need to be either.
+		if strings.EqualFold(nfo.name, distro) {
+			return nfo, true, nil
+		}
+	}
+
+	return distroInfo{}, false, nil
+}
+
+// distroCheck returns true of distro is in the WSL distribution list, false if not or an error.
+func distroCheck(lg *log.Logger, distro string) (bool, error) {
+	nfo, ok, err := findDistro(distro)
+	if err != nil || !ok {
+		return false, err
 	}
 
-	cmd := fmt.Sprintf("--export %s%s %s", distro, fmtarg, of)
-	log.Printf("Exporting distribution %q for backup to file %q in %v format...\n", distro, of, format)
-	res, err := wslCmd(cmd)
+	if nfo.state == "Stopped" {
+		return true, nil
+	}
+
+	if *term {
+		lg.Printf("Found %v distro but it is running, shutting down WSL as requested...\n", nfo.name)
+		_, err = wslCmd("--shutdown")
+		if err != nil {
+			return false, err
+		}
+
+		// Check again now, recursively.
+		return distroCheck(lg, distro)
+	}
+
+	return false, fmt.Errorf("%w: found distribution %s but it is running and -s flag not specified so it will not be shutdown", errRunning, nfo.name)
+}
+
+// terminateDistro terminates distro if it is running, without touching any other distribution.
+func terminateDistro(distro string) error {
+	nfo, ok, err := findDistro(distro)
 	if err != nil {
-		log.Printf("Failed: %s\n", res)
 		return err
 	}
 
-	log.Printf("Export suceeded: %s", res)
+	if !ok {
+		return fmt.Errorf("distro %q not found in WSL, check installed distribution with \"%s %s\"", distro, wsl, wslList)
+	}
+
+	if nfo.state == "Stopped" {
+		log.Printf("Distribution %s was not running.\n", nfo.name)
+		return nil
+	}
+
+	if _, err := wslCmd("--terminate " + nfo.name); err != nil {
+		return fmt.Errorf("error terminating %s: %v", nfo.name, err)
+	}
+	log.Printf("Distribution %s was running and has been terminated.\n", nfo.name)
 
 	return nil
 }
 
-func zipFile(fn string) error {
-	zof := fn + ".zip"
-	log.Printf("Compressing %s file to %s...\n", fn, zof)
+// distroRunning returns true if distro is running, for restoreRunState.
+func distroRunning(distro string) bool {
+	nfo, ok, err := findDistro(distro)
+	return err == nil && ok && nfo.state == "Running"
+}
+
+// restoreRunState terminates distro unless wasRunning. Running a command inside a distribution
+// starts it, so anything that does calls this afterwards to leave the distribution the way it found
+// it: stopped ready for export, or still running for whoever was using it.
+func restoreRunState(distro string, wasRunning bool) error {
+	if wasRunning {
+		return nil
+	}
+
+	_, err := wslCmd("--terminate " + distro)
+	return err
+}
+
+// vhdUnsupported guesses from the output of a failed vhdx export whether it failed because --vhd is not
+// supported. Older WSL builds reject --vhd as an unknown option, the inbox WSL which cannot export vhdx
+// at all does not know --version either, and WSL 1 distributions have no vhdx to export.
+func vhdUnsupported(res []byte) bool {
+	if bytes.Contains(res, []byte("--vhd")) || bytes.Contains(res, []byte("WSL2")) || bytes.Contains(res, []byte("WSL 2")) {
+		return true
+	}
+
+	_, err := wslVersion()
+	return err != nil
+}
+
+// exportCmd returns the command writing a tar export of distro to stdout. This is normally
+// "wsl --export <distro> -", but when paths are excluded tar is run inside the distribution as root
+// instead since wsl --export has no way to leave anything out.
+func exportCmd(distro string) *exec.Cmd {
+	if !distroTar() {
+		return exec.CommandContext(runCtx, wsl, append([]string{"--export", distro, "-"}, exportArgs...)...)
+	}
+
+	args := []string{"-d", distro, "-u", "root", "--exec", "tar", "-C", "/", "-cpf", "-", "--one-file-system", "--numeric-owner"}
+	for _, e := range *excludes {
+		// Archived paths are relative to / and start with "./".
+		args = append(args, "--exclude=./"+strings.TrimPrefix(e, "/"))
+	}
+	for _, g := range excludeGlobs {
+		args = append(args, "--exclude="+tarGlob(g))
+	}
+
+	if len(*paths) == 0 {
+		return exec.CommandContext(runCtx, wsl, append(args, ".")...)
+	}
+
+	for _, p := range *paths {
+		args = append(args, "./"+strings.Trim(p, "/"))
+	}
+
+	return exec.CommandContext(runCtx, wsl, args...)
+}
+
+// distroTar returns true if the export is made by running tar inside the distribution rather than by
+// "wsl --export", which -exclude-path and -paths need.
+func distroTar() bool {
+	return len(*excludes) > 0 || len(excludeGlobs) > 0 || len(*paths) > 0
+}
 
-	// Create the ZIP file.
-	zf, err := os.Create(zof)
+// readExcludeFrom reads the glob patterns in the file fn, one per line as in a .gitignore file.
+// Blank lines and lines starting with # are skipped.
+func readExcludeFrom(fn string) ([]string, error) {
+	b, err := os.ReadFile(fn)
 	if err != nil {
-		return fmt.Errorf("error creating zip file: %v", err)
+		return nil, fmt.Errorf("error reading -exclude-from file: %v", err)
+	}
+
+	var globs []string
+	for _, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		if strings.Trim(l, "/") == "" {
+			return nil, fmt.Errorf("pattern %q in %s would exclude everything", l, fn)
+		}
+		globs = append(globs, l)
+	}
+
+	return globs, nil
+}
+
+// tarGlob translates the -exclude-from pattern p into a tar --exclude pattern. As in a .gitignore
+// file, a pattern containing a slash is relative to the root of the distribution while one without
+// matches at any depth.
+func tarGlob(p string) string {
+	p = strings.TrimSuffix(p, "/")
+	if !strings.Contains(p, "/") {
+		return p
+	}
+
+	return "./" + strings.TrimPrefix(p, "/")
+}
+
+// warnUnmatched warns about -exclude-from patterns that match nothing in distro, which are usually
+// typos. A single find over the filesystem checks them all.
+func warnUnmatched(lg *log.Logger, distro string) {
+	args := []string{"-d", distro, "-u", "root", "--exec", "find", "/", "-xdev", "("}
+	for i, g := range excludeGlobs {
+		if i > 0 {
+			args = append(args, "-o")
+		}
+
+		test, val := "-name", tarGlob(g)
+		if strings.HasPrefix(val, "./") {
+			test, val = "-path", val[1:]
+		}
+		// Print the index of the pattern, not descending into what it matched just as tar won't.
+		args = append(args, test, val, "-printf", fmt.Sprintf("%d\\n", i), "-prune")
+	}
+
+	// find fails on files it can't read but still reports everything else.
+	out, err := exec.Command(wsl, append(args, ")")...).Output()
+	if err != nil && len(out) == 0 {
+		lg.Printf("Warning: could not check which -exclude-from patterns match: %v", err)
+		return
 	}
 
-	w := zip.NewWriter(zf)
+	matched := make(map[string]bool)
+	for _, l := range strings.Fields(string(out)) {
+		matched[l] = true
+	}
+
+	for i, g := range excludeGlobs {
+		if !matched[strconv.Itoa(i)] {
+			lg.Printf("Warning: -exclude-from pattern %q matches nothing in %s.\n", g, distro)
+		}
+	}
+}
+
+// checkPaths returns an error if any of the -paths don't exist in distro.
+func checkPaths(distro string) error {
+	for _, p := range *paths {
+		if err := exec.Command(wsl, "-d", distro, "-u", "root", "--exec", "test", "-e", p).Run(); err != nil {
+			return fmt.Errorf("path %s does not exist in %s: %v", p, distro, err)
+		}
+	}
+
+	return nil
+}
+
+// runExport runs the export command cmd writing the tar to w.
+func runExport(lg *log.Logger, cmd *exec.Cmd, w io.Writer) error {
+	var stderr bytes.Buffer
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+
+	// tar exits 1 when files changed while they were read, which is expected in a running distribution.
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.ExitCode() == 1 && distroTar() {
+		lg.Printf("Warning: some files changed while being archived: %s\n", bytes.TrimSpace(stderr.Bytes()))
+		return nil
+	}
 
-	// Create the inner compressed file.
-	cf, err := w.Create(fn)
 	if err != nil {
-		return fmt.Errorf("error creating zip directory: %v", err)
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(stderr.Bytes()))
 	}
 
-	// Open the original file.
-	uf, err := os.Open(fn)
+	return nil
+}
+
+// tarExport exports distro as a tar to the file of using exportCmd.
+func tarExport(lg *log.Logger, distro, of string) error {
+	what := "everything"
+	if len(*paths) > 0 {
+		what = strings.Join(*paths, ", ")
+	}
+	if ex := append(append([]string{}, *excludes...), excludeGlobs...); len(ex) > 0 {
+		what += " excluding " + strings.Join(ex, ", ")
+	}
+	lg.Printf("Exporting %s of distribution %q for backup to file %q in tar format...\n", what, distro, of)
+	f, err := os.Create(of)
 	if err != nil {
-		return fmt.Errorf("error opening exported file: %v", err)
+		return err
+	}
+
+	p := newProgress("export", of, 0)
+	if err := runExport(lg, exportCmd(distro), io.MultiWriter(f, p)); err != nil {
+		f.Close()
+		return err
 	}
+	p.finish()
 
-	io.Copy(cf, uf)
-	if err = w.Close(); err != nil {
+	if err := f.Close(); err != nil {
 		return err
 	}
 
-	if err = uf.Close(); err != nil {
+	lg.Println("Export suceeded.")
+
+	return nil
+}
+
+// wslExport exports distro to the file of in format.
+func wslExport(lg *log.Logger, distro, format, of string) error {
+	args := []string{"--export", distro}
+	if format == "vhdx" {
+		args = append(args, "--vhd")
+	}
+	args = append(append(args, of), exportArgs...)
+
+	lg.Printf("Exporting distribution %q for backup to file %q in %v format...\n", distro, of, format)
+	stop := watchFile("export", of)
+	res, err := wslArgsContext(runCtx, args...)
+	stop()
+	if err != nil {
+		lg.Printf("Failed: %s\n", res)
+		if format == "vhdx" && vhdUnsupported(res) {
+			return fmt.Errorf("%w, update WSL with \"%s --update\" or use -f tar", errVHDUnsupported, wsl)
+		}
 		return err
 	}
 
-	log.Println("Compression completed successfully.")
+	lg.Printf("Export suceeded: %s", res)
 
 	return nil
 }
 
 // compactFile compresses a file using the OS compact command which uses NTFS compression to reduce the size
-// of the backup on disk.
-func compactFile(fn string) error {
-	cmd := exec.Command(compactexe, "/c", fn)
+// of the backup on disk. It returns the number of bytes of disk space saved.
+func compactFile(lg *log.Logger, fn string) (int64, error) {
+	cmd := exec.CommandContext(runCtx, compactexe, "/c", fn)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if err := cmd.Start(); err != nil {
-		return err
+		return 0, err
 	}
 	result, err := io.ReadAll(stdout)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if err := cmd.Wait(); err != nil {
-		return err
+		return 0, err
 	}
 
-	if strings.Contains(string(result), "1 files within 1 directories were compressed") {
-		log.Println("Compression completed successfully.")
-		return nil
+	if !strings.Contains(string(result), "1 files within 1 directories were compressed") {
+		return 0, fmt.Errorf("compact failed: %s", result)
 	}
 
-	return fmt.Errorf("compact failed: %s", result)
-}
-
-// outputName takes an output format and returns a output filename when one was not provided on
-// command line.
-func outputName(format, distro string) string {
-	return fmt.Sprintf("%s-%s.%s", time.Now().Format("200601021504"), distro, format)
-}
+	lg.Println("Compression completed successfully.")
 
-func main() {
-	flag.Parse()
-
-	// Validate outfmt format.
-	switch *outfmt {
-	case "vhdx", "tar":
-	case "zip":
-		log.Fatal("To output in zip format, use --z flag. --f flag is to provide the export file format (vhdx or tar).")
-	default:
-		log.Fatalf("Output format %q not supported. Supported formats are \"vhdx\" (default) and \"tar\".", *outfmt)
+	// Compact reports "X total bytes of data are stored in Y bytes." using locale digit grouping.
+	m := regexp.MustCompile(`([\d,.]+) total bytes of data are stored in ([\d,.]+) bytes`).FindStringSubmatch(string(result))
+	if m == nil {
+		lg.Println("Could not determine how much space compact saved.")
+		return 0, nil
 	}
 
-	// Validate compression choice.
-	if *outzip && *compact {
-		log.Fatalf("Invalid arguments: Choose --z for ZIP or --c for Compact, but not both.")
+	digits := func(s string) int64 {
+		n, _ := strconv.ParseInt(regexp.MustCompile(`\D`).ReplaceAllString(s, ""), 10, 64)
+		return n
 	}
+	before, after := digits(m[1]), digits(m[2])
+	saved := before - after
+	if before > 0 {
+		lg.Printf("NTFS compression saved %d bytes (%d bytes stored in %d, %.1f%%).\n", saved, before, after, float64(saved)*100/float64(before))
+	}
+
+	return saved, nil
+}
 
-	// Validate distribution specified.
-	d, err := distroCheck(*distro)
+// trimDistro runs fstrim in distro to tell its virtual disk which blocks are unused, then terminates it
+// and marks the virtual disk sparse so WSL gives those blocks back. Old WSL releases can't make disks
+// sparse, which is only a warning since fstrim alone still helps compact and compression. A distribution
+// that was already running is left running.
+func trimDistro(lg *log.Logger, distro string) error {
+	lg.Printf("Trimming the virtual disk of %s...\n", distro)
+	running := distroRunning(distro)
+	cmd := exec.Command(wsl, "-d", distro, "-u", "root", "--exec", "fstrim", "-v", "/")
+	out, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("error running fstrim in %s: %v: %s", distro, err, bytes.TrimSpace(out))
 	}
+	lg.Printf("%s\n", bytes.TrimSpace(out))
 
-	if !d {
-		log.Fatalf("Distro %q not found in WSL, check installed distribution with \"%s %s\"", *distro, wsl, wslList)
+	if err := restoreRunState(distro, running); err != nil {
+		return err
 	}
 
-	// If no output filename provided, create a sane one.
-	of := *outfile
-	if *outfile == "" {
-		of = outputName(*outfmt, *distro)
+	// The disk of a running distribution, being backed up with -fsfreeze, can't be changed.
+	if running {
+		lg.Printf("Not making the virtual disk of %s sparse since it is running.\n", distro)
+		return nil
 	}
 
-	// Do the export.
-	if err = wslExport(*distro, *outfmt, of); err != nil {
-		log.Fatal(err)
+	if res, err := wslCmd("--manage " + distro + " --set-sparse true"); err != nil {
+		lg.Printf("Warning: could not make the virtual disk of %s sparse: %v %s\n", distro, err, bytes.TrimSpace(res))
 	}
 
-	// ZIP the output if requested.
-	if *outzip {
-		if err := zipFile(of); err != nil {
-			log.Fatal(err)
+	return nil
+}
+
+// bootDistro starts distro with a no-op command and gives it wait to settle, so any first boot
+// initialization completes, before terminating it again ready for export. A distribution that was
+// already running has booted, and is left running.
+func bootDistro(lg *log.Logger, distro string, wait time.Duration) error {
+	if distroRunning(distro) {
+		lg.Printf("%s is already running, not booting it.\n", distro)
+		return nil
+	}
+
+	lg.Printf("Booting %s and waiting %v for it to settle before the backup...\n", distro, wait)
+	if _, err := wslExec(distro, "true"); err != nil {
+		return fmt.Errorf("error booting %s: %v", distro, err)
+	}
+
+	time.Sleep(wait)
+
+	return restoreRunState(distro, false)
+}
+
+// verifyVHD checks the structure of the vhdx file fn using the Hyper-V Test-VHD cmdlet. If Hyper-V or
+// its PowerShell module is not available the check is skipped with a warning.
+func verifyVHD(lg *log.Logger, fn string) error {
+	lg.Printf("Verifying %s with Test-VHD...\n", fn)
+	cmd := exec.Command(powershell, "-NoProfile", "-NonInteractive", "-Command", testVHD)
+	cmd.Env = append(os.Environ(), "WSL2BACKUP_VHD="+fn)
+	out, err := cmd.Output()
+
+	var ee *exec.ExitError
+	switch {
+	case err == nil:
+		lg.Println("Test-VHD reports the virtual disk is valid.")
+		return nil
+	case errors.As(err, &ee) && ee.ExitCode() == 1:
+		return fmt.Errorf("Test-VHD reports %s is not a valid virtual disk", fn)
+	case errors.As(err, &ee) && ee.ExitCode() == 2:
+		lg.Println("Warning: the Hyper-V PowerShell module is not installed, skipping Test-VHD verification.")
+	default:
+		lg.Printf("Warning: could not run Test-VHD, skipping verification: %v %s\n", err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
+
+// mountVerify mounts the vhdx file fn read-only in WSL and lists its root directory from distro,
+// proving the filesystem can be read and not just that the disk is well formed. Mounting needs an
+// elevated prompt. The disk is always unmounted, and distro put back the way it was, afterwards.
+func mountVerify(lg *log.Logger, distro, fn string) error {
+	abs, err := filepath.Abs(fn)
+	if err != nil {
+		return err
+	}
+
+	running := distroRunning(distro)
+
+	name := "wsl2backup-" + runID
+	lg.Printf("Mounting %s read-only to verify it...\n", fn)
+	if out, err := exec.Command(wsl, "--mount", abs, "--vhd", "--name", name, "--options", "ro").CombinedOutput(); err != nil {
+		msg, _ := decodeOutput(out)
+		return fmt.Errorf("error mounting %s, which needs an elevated prompt: %v: %s", fn, err, bytes.TrimSpace(msg))
+	}
+	defer func() {
+		if out, err := exec.Command(wsl, "--unmount", abs).CombinedOutput(); err != nil {
+			msg, _ := decodeOutput(out)
+			lg.Printf("Warning: error unmounting %s: %v: %s", fn, err, bytes.TrimSpace(msg))
+		}
+		if err := restoreRunState(distro, running); err != nil {
+			lg.Printf("Warning: error terminating %s: %v", distro, err)
+		}
+	}()
+
+	out, err := exec.Command(wsl, "-d", distro, "-u", "root", "--exec", "ls", "-A", "/mnt/wsl/"+name).Output()
+	if err != nil {
+		return fmt.Errorf("error reading the filesystem mounted from %s: %v", fn, err)
+	}
+
+	entries := len(bytes.Fields(out))
+	if entries == 0 {
+		return fmt.Errorf("the filesystem mounted from %s is empty", fn)
+	}
+	lg.Printf("Mounted %s and read %d entries in its root directory.\n", fn, entries)
+
+	return nil
+}
+
+// splitCommand splits the command line s into arguments at spaces, except within double quotes, so
+// paths such as "C:\Program Files\tool.exe" can be given. Backslashes are taken as they are.
+func splitCommand(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	quoted, inArg := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted, inArg = !quoted, true
+		case (r == ' ' || r == '\t') && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+			}
+			inArg = false
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in %s", s)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args, nil
+}
+
+// verifyCmd runs -verify-cmd against the backup file fn of distro, returning an error if it fails.
+// The variables passed to it don't name a flag, so a wsl2backup run by it doesn't take them as one.
+func verifyCmd(lg *log.Logger, distro, fn string) error {
+	args, _ := splitCommand(*verifcmd)
+	args = append(args, fn)
+	lg.Printf("Verifying %s with %q...\n", fn, *verifcmd)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "WSL2BACKUP_VERIFY_FILE="+fn, "WSL2BACKUP_VERIFY_DISTRO="+distro)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("-verify-cmd failed on %s: %v: %s", fn, err, bytes.TrimSpace(out))
+	}
+
+	lg.Println("Verification command succeeded.")
+
+	return nil
+}
+
+// symlinkScan lists symlinks in the distribution with absolute targets. These resolve against
+// whatever root they are restored into, and ones pointing under /mnt reference Windows drives which
+// are not part of the backup at all.
+func symlinkScan(lg *log.Logger, distro string) error {
+	lg.Printf("Scanning %s for absolute symlinks...\n", distro)
+	running := distroRunning(distro)
+	res, err := wslExec(distro, "find", "/", "-xdev", "-type", "l", "-lname", "/*", "-printf", "%p\t%l\n")
+	if err != nil && len(res) == 0 {
+		return fmt.Errorf("symlink scan failed: %v", err)
+	}
+
+	var abs, mnt int
+	for _, l := range strings.Split(strings.TrimSpace(string(res)), "\n") {
+		link, target, ok := strings.Cut(l, "\t")
+		if !ok {
+			continue
+		}
+
+		abs++
+		if strings.HasPrefix(target, "/mnt/") {
+			mnt++
+			lg.Printf("Symlink %s -> %s points outside the distribution filesystem.\n", link, target)
+		}
+	}
+	lg.Printf("Found %d absolute symlinks, %d pointing outside the distribution filesystem.\n", abs, mnt)
+
+	return restoreRunState(distro, running)
+}
+
+// captureConfig saves the distribution's /etc/wsl.conf and /etc/fstab as sidecar text files next to
+// the backup file fn so the configuration is visible without mounting the backup.
+func captureConfig(lg *log.Logger, distro, fn string) error {
+	running := distroRunning(distro)
+	for _, conf := range []string{"/etc/wsl.conf", "/etc/fstab"} {
+		res, err := wslExec(distro, "cat", conf)
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			lg.Printf("No %s in %s, skipping.\n", conf, distro)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", conf, err)
+		}
+
+		side := fn + "." + filepath.Base(conf)
+		if err := os.WriteFile(side, res, 0644); err != nil {
+			return err
+		}
+		lg.Printf("Saved %s to %s.\n", conf, side)
+	}
+
+	return restoreRunState(distro, running)
+}
+
+// diskUsage saves the sizes in KB of the directories in distro down to depth levels, as reported by du,
+// to the sidecar file fn + ".du.txt". The output is written straight to the file since it can be large.
+func diskUsage(lg *log.Logger, distro, fn string, depth int) error {
+	side := fn + ".du.txt"
+	f, err := os.Create(side)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	running := distroRunning(distro)
+	var stderr bytes.Buffer
+	cmd := exec.Command(wsl, "-d", distro, "-u", "root", "--exec", "du", "-x", "-k", fmt.Sprintf("--max-depth=%d", depth), "/")
+	cmd.Stdout = f
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+
+	// du exits 1 when it couldn't read some directories but still reports on the rest.
+	var ee *exec.ExitError
+	switch {
+	case errors.As(err, &ee) && ee.ExitCode() == 1:
+		lg.Printf("Warning: du could not read everything: %s\n", bytes.TrimSpace(stderr.Bytes()))
+	case err != nil:
+		f.Close()
+		os.Remove(side)
+		return fmt.Errorf("error running du: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	lg.Printf("Disk usage report saved to %s.\n", side)
+
+	return restoreRunState(distro, running)
+}
+
+// wslConfigPath returns the path of the global WSL settings file, %UserProfile%\.wslconfig.
+func wslConfigPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".wslconfig"), nil
+}
+
+// copyFile copies the file src to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// saveWSLConfig copies .wslconfig to fn.wslconfig alongside the backup if it exists.
+func saveWSLConfig(lg *log.Logger, fn string) error {
+	src, err := wslConfigPath()
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(src); errors.Is(err, fs.ErrNotExist) {
+		lg.Printf("No %s to save, skipping.\n", src)
+		return nil
+	}
+
+	if err := copyFile(src, fn+".wslconfig"); err != nil {
+		return fmt.Errorf("error saving %s: %v", src, err)
+	}
+	lg.Printf("Saved %s to %s.wslconfig.\n", src, fn)
+
+	return nil
+}
+
+// parseSize parses a human readable size such as "100MB" or "2GB" into bytes. A bare number is taken
+// as bytes and the units are binary multiples (1KB == 1024 bytes).
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mult   int64
+	}{
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1},
+	}
+
+	num := strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num = strings.TrimSpace(strings.TrimSuffix(num, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	return n * mult, nil
+}
+
+// sizeCheck returns an error if the file fn is smaller than min bytes.
+func sizeCheck(fn string, min int64) error {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() < min {
+		return fmt.Errorf("%w: %s is only %d bytes, smaller than the minimum of %d bytes, the export may have failed", errTooSmall, fn, fi.Size(), min)
+	}
+
+	return nil
+}
+
+// windowsVarRE matches a Windows style %VAR% environment variable reference.
+var windowsVarRE = regexp.MustCompile(`%([A-Za-z_][A-Za-z0-9_()]*)%`)
+
+// expandPath expands environment variables in the path p, both $VAR or ${VAR} and Windows style %VAR%,
+// returning an error if a variable isn't set.
+func expandPath(p string) (string, error) {
+	var missing []string
+	lookup := func(name string) string {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	}
+
+	p = windowsVarRE.ReplaceAllStringFunc(p, func(m string) string { return lookup(m[1 : len(m)-1]) })
+	p = os.Expand(p, lookup)
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+
+	return p, nil
+}
+
+// maxSizeCheck returns an error if the file fn is larger than max bytes.
+func maxSizeCheck(fn string, max int64) error {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() > max {
+		return fmt.Errorf("%w: %s is %d bytes, larger than the maximum of %d bytes, something may be filling the distribution", errTooLarge, fn, fi.Size(), max)
+	}
+
+	return nil
+}
+
+// partialName returns the in-progress name for output file fn. The extension is kept last since WSL
+// expects vhdx exports to have a .vhdx extension.
+func partialName(fn string) string {
+	ext := filepath.Ext(fn)
+	return strings.TrimSuffix(fn, ext) + ".partial" + ext
+}
+
+// finalize renames the in-progress file work to fn. os.Rename is atomic on the same volume so anything
+// watching the output directory never sees an incomplete backup.
+func finalize(work, fn string) error {
+	if work == fn {
+		return nil
+	}
+
+	if err := os.Rename(work, fn); err != nil {
+		return fmt.Errorf("error renaming %s to %s: %v", work, fn, err)
+	}
+
+	return nil
+}
+
+// unsafeNameRE matches runs of characters we don't put in filenames.
+var unsafeNameRE = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// fileDistro returns the name of distro used in backup filenames, which is -friendly-name if set.
+func fileDistro(distro string) string {
+	if *friendly == "" {
+		return distro
+	}
+
+	return strings.Trim(unsafeNameRE.ReplaceAllString(*friendly, "-"), "-.")
+}
+
+// outputName takes an output format and returns a output filename when one was not provided on
+// command line.
+func outputName(format, distro string) string {
+	return fmt.Sprintf("%s-%s.%s", runStart.Format("200601021504"), distro, format)
+}
+
+// uniqueName returns the path in dir for a new backup of distro in format. If a backup from the same
+// minute is already there, or its compressed copy with extension ext is there or in -compressed-dir,
+// a counter is added to the name so it isn't overwritten. WSL doesn't allow "~" in distribution
+// names so the counter can always be told apart from the name.
+func uniqueName(dir, format, distro, ext string) string {
+	exists := func(fn string) bool {
+		paths := []string{fn, fn + ext}
+		if *zipdir != "" {
+			paths = append(paths, filepath.Join(*zipdir, filepath.Base(fn)+ext))
+		}
+		for _, f := range paths {
+			if _, err := os.Stat(f); err == nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	of := filepath.Join(dir, outputName(format, distro))
+	for n := 1; !*overwrt && exists(of); n++ {
+		of = filepath.Join(dir, outputName(format, fmt.Sprintf("%s~%d", distro, n)))
+	}
+
+	return of
+}
+
+// backupName is a filename created by outputName, parsed back into its parts.
+type backupName struct {
+	time           time.Time
+	distro, format string
+	// seq is the counter uniqueName added to tell apart backups made in the same minute.
+	seq int
+	// ext is anything after the format such as ".zip" or ".registry.json" for sidecar files.
+	ext string
+}
+
+// backupNameRE matches the names created by outputName, the distro is matched lazily since names like
+// Ubuntu-22.04 contain dots.
+var backupNameRE = regexp.MustCompile(`^(\d{12})-(.+?)(?:~(\d+))?\.(vhdx|tar)((?:\.[^.]+)*)$`)
+
+// bundleNameRE matches the names created by bundleName.
+var bundleNameRE = regexp.MustCompile(`^(\d{12})-bundle(\.zip(?:\.[^.]+)*)$`)
+
+// bundleDistro is the distribution of a -bundle file in its backupName, standing for all of them. It
+// can't be the name of a real distribution.
+const bundleDistro = "*"
+
+// bundleName returns the name of the -bundle file for this run.
+func bundleName() string {
+	return runStart.Format("200601021504") + "-bundle.zip"
+}
+
+// parseBackupName parses a filename created by outputName or bundleName, returning false if fn is not
+// one. A bundle has the distribution bundleDistro and the format "bundle".
+func parseBackupName(fn string) (backupName, bool) {
+	if m := bundleNameRE.FindStringSubmatch(filepath.Base(fn)); m != nil {
+		t, err := time.ParseInLocation("200601021504", m[1], time.Local)
+		return backupName{t, bundleDistro, "bundle", 0, m[2]}, err == nil
+	}
+
+	m := backupNameRE.FindStringSubmatch(filepath.Base(fn))
+	if m == nil {
+		return backupName{}, false
+	}
+
+	t, err := time.ParseInLocation("200601021504", m[1], time.Local)
+	if err != nil {
+		return backupName{}, false
+	}
+
+	seq, _ := strconv.Atoi(m[3])
+	return backupName{t, m[2], m[4], seq, m[5]}, true
+}
+
+// newer returns true if b was made after o.
+func (b backupName) newer(o backupName) bool {
+	if b.time.Equal(o.time) {
+		return b.seq > o.seq
+	}
+
+	return b.time.After(o.time)
+}
+
+// backupDir returns the base directory backups are written to.
+func backupDir() string {
+	if *outdir == "" {
+		return "."
+	}
+
+	return *outdir
+}
+
+// outputDir returns the directory to write a new backup to, creating today's year/month/day
+// subdirectory of backupDir when -partition is set.
+func outputDir() (string, error) {
+	dir := backupDir()
+	if *datepart {
+		dir = filepath.Join(dir, runStart.Format("2006"), runStart.Format("01"), runStart.Format("02"))
+	}
+
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// checkTarget returns an error if the drive dir is on is not connected, or dir can't be written to.
+func checkTarget(dir string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	vol := filepath.VolumeName(abs)
+	if _, err := os.Stat(vol + string(filepath.Separator)); err != nil {
+		return fmt.Errorf("backup drive %s not available: %v", vol, err)
+	}
+
+	if err := os.MkdirAll(abs, 0755); err != nil {
+		return fmt.Errorf("backup directory %s not available: %v", abs, err)
+	}
+
+	f, err := os.CreateTemp(abs, "wsl2backup-check-*.tmp")
+	if err != nil {
+		return fmt.Errorf("backup directory %s is not writable: %v", abs, err)
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
+}
+
+// existingBackups returns the paths of the files in backupDir, including those in the date
+// partitions below it when -partition is set, and in -compressed-dir.
+func existingBackups() ([]string, error) {
+	var paths []string
+	roots := []string{backupDir()}
+	if *zipdir != "" && filepath.Clean(*zipdir) != filepath.Clean(backupDir()) {
+		roots = append(roots, *zipdir)
+	}
+
+	for _, root := range roots {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if d.IsDir() {
+				if path != root && !*datepart {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			paths = append(paths, path)
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	return paths, nil
+}
+
+// generationName returns the output filename for the next of n rolling generations of distro backups
+// in dir, along with the files of the backup already in that slot. The slot after the most recently
+// written generation is used, wrapping back to the first after n. The old files are left alone for
+// rotateGeneration to remove once the new backup is in place.
+func generationName(lg *log.Logger, dir, format, distro string, n int) (string, []string, error) {
+	paths, err := existingBackups()
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Match compressed copies and sidecar files too so they are rotated out with the backup.
+	re := regexp.MustCompile(`^` + regexp.QuoteMeta(distro) + `\.(\d{3})\.` + regexp.QuoteMeta(format) + `(\..+)?$`)
+	var last int
+	var newest time.Time
+	slots := make(map[int][]string)
+	for _, p := range paths {
+		m := re.FindStringSubmatch(filepath.Base(p))
+		if m == nil {
+			continue
+		}
+
+		fi, err := os.Stat(p)
+		if err != nil {
+			return "", nil, err
+		}
+
+		g, _ := strconv.Atoi(m[1])
+		slots[g] = append(slots[g], p)
+		if g <= n && fi.ModTime().After(newest) {
+			last, newest = g, fi.ModTime()
+		}
+	}
+
+	slot := last%n + 1
+	lg.Printf("Using generation slot %d of %d.\n", slot, n)
+
+	return filepath.Join(dir, fmt.Sprintf("%s.%03d.%s", distro, slot, format)), slots[slot], nil
+}
+
+// rotateGeneration removes the files old of the previous backup in a generation slot, now that the
+// new backup has replaced it, except for those in keep that the new backup was moved into.
+func rotateGeneration(lg *log.Logger, old []string, keep ...string) {
+	for _, fn := range old {
+		if slices.Contains(keep, fn) {
+			continue
+		}
+
+		lg.Printf("Rotating out old generation file %s...\n", fn)
+		if err := os.Remove(fn); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			lg.Printf("Warning: %v", err)
+		}
+	}
+}
+
+// backup runs the whole backup of a single distribution, logging to lg.
+func backup(lg *log.Logger, distro string) result {
+	if err := cancelErr(); err != nil {
+		return result{distro: distro, err: err}
+	}
+
+	start := time.Now()
+	res := result{distro: distro}
+	res.file, res.size, res.saved, res.err = runBackup(lg, distro)
+	phases.Delete(distro)
+	res.duration = time.Since(start)
+	if err := cancelErr(); res.err != nil && err != nil {
+		res.err = err
+	}
+	if *webhook != "" && (res.err != nil && !res.skipped() || !*hookfail) {
+		if err := postWebhook(*webhook, res); err != nil {
+			lg.Printf("Warning: %v", err)
+		}
+	}
+
+	if *evlog {
+		if err := writeEvent(res); err != nil {
+			lg.Printf("Warning: %v", err)
+		}
+	}
+
+	return res
+}
+
+// runBackup does the work of backup by running backupStages, returning the name of the backup file
+// produced, its size and the space saved by compact.
+func runBackup(lg *log.Logger, distro string) (string, int64, int64, error) {
+	j := &backupJob{lg: lg, distro: distro}
+	if err := j.run(); err != nil {
+		return "", 0, 0, err
+	}
+
+	// A backup completed by its export, such as one streamed to -stdout, was never uploaded.
+	if j.size == 0 {
+		if fi, err := os.Stat(j.final); err == nil {
+			j.size = fi.Size()
+		}
+	}
+
+	return j.final, j.size, j.saved, nil
+}
+
+// result is the outcome of backing up a single distribution.
+type result struct {
+	distro, file string
+	size         int64
+	saved        int64 // Bytes saved by compact.
+	duration     time.Duration
+	err          error
+}
+
+// watchCancel cancels the run once the file fn appears.
+func watchCancel(fn string) {
+	for range time.Tick(cancelPoll) {
+		if _, err := os.Stat(fn); err == nil {
+			log.Printf("Found %s, cancelling the backup.\n", fn)
+			cancelRun()
+			return
+		}
+	}
+}
+
+// selectDistros returns the distributions in list whose names match -match and not -exclude-match.
+func selectDistros(list []distroInfo) []distroInfo {
+	var sel []distroInfo
+	for _, d := range list {
+		if (matchRE == nil || matchRE.MatchString(d.name)) && (noMatchRE == nil || !noMatchRE.MatchString(d.name)) {
+			sel = append(sel, d)
+		}
+	}
+
+	return sel
+}
+
+// backupAll backs up every installed distribution using a pool of -parallel workers, logs a summary
+// and returns the results.
+func backupAll() []result {
+	distros, err := listDistros()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if distros = selectDistros(distros); len(distros) == 0 {
+		log.Fatal("No installed distributions match -match and -exclude-match.")
+	}
+
+	// Shutting down WSL part way through would kill exports running in other workers, so do it once
+	// up front instead.
+	if *term {
+		log.Println("Shutting down WSL as requested...")
+		if _, err := wslCmd("--shutdown"); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	holdLog()
+	results := make([]result, len(distros))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	for w := 0; w < *parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				name := distros[i].name
+				if *failfast && failed.Load() {
+					results[i] = result{distro: name, err: errSkipped}
+					continue
+				}
+
+				lg := log.New(log.Writer(), log.Prefix()+"["+name+"] ", log.LstdFlags|log.Lmsgprefix)
+				results[i] = backup(lg, name)
+				if results[i].skipped() {
+					lg.Printf("Skipping backup: %v", results[i].err)
+				} else if results[i].err != nil {
+					lg.Print(red(fmt.Sprintf("Error: %v", results[i].err)))
+					failed.Store(true)
+				}
+			}
+		}()
+	}
+
+	for i := range distros {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if *bundle {
+		bundleResults(results)
+	}
+
+	log.Printf("Backed up %d distributions:\n", len(results))
+	for _, r := range results {
+		if r.skipped() {
+			log.Printf("  %s: SKIPPED: %v\n", r.distro, r.err)
+			continue
+		}
+		if r.err != nil {
+			log.Print(red(fmt.Sprintf("  %s: FAILED: %v", r.distro, r.err)))
+			continue
+		}
+		if r.saved > 0 {
+			log.Print(green(fmt.Sprintf("  %s: %s (compact saved %d bytes)", r.distro, r.file, r.saved)))
+			continue
+		}
+		log.Print(green(fmt.Sprintf("  %s: %s", r.distro, r.file)))
+	}
+
+	return results
+}
+
+// bundleResults puts the exports of the successful results, with their sidecar files, into one ZIP
+// file in -dir, deleting them afterwards unless -keep is set, and points the results at it. The bundle
+// gets its own checksum with -checksum and is pruned with -keep-last and -keep-days like a backup.
+func bundleResults(results []result) {
+	var files []string
+	for _, r := range results {
+		if r.err == nil {
+			files = append(files, r.file)
+			files = append(files, sidecars(r.file)...)
+		}
+	}
+
+	if len(files) == 0 {
+		return
+	}
+
+	dir, err := outputDir()
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return
+	}
+
+	dst := filepath.Join(dir, bundleName())
+	work := dst
+	if !*noatom {
+		work = partialName(dst)
+	}
+
+	err = bundleFiles(log.Default(), work, files)
+	if err == nil && *checksum {
+		_, err = writeChecksum(*sumalgo, work, dst)
+	}
+	if err == nil {
+		err = finalize(work, dst)
+	}
+	if err == nil && *checksum {
+		err = finalize(work+checksumAlgos[*sumalgo].ext, dst+checksumAlgos[*sumalgo].ext)
+	}
+	if err != nil {
+		os.Remove(work + checksumAlgos[*sumalgo].ext)
+		log.Print(red(fmt.Sprintf("Error: bundling failed, the separate backups are kept: %v", err)))
+		return
+	}
+
+	log.Print(green(fmt.Sprintf("Bundle written to %s.", dst)))
+	if !*keep {
+		for _, f := range files {
+			if err := os.Remove(f); err != nil {
+				log.Printf("Warning: error removing %s after bundling it: %v", f, err)
+			}
+		}
+	}
+
+	var size int64
+	if fi, err := os.Stat(dst); err == nil {
+		size = fi.Size()
+	}
+	for i := range results {
+		if results[i].err == nil {
+			results[i].file, results[i].size = dst, size
+		}
+	}
+
+	if *keeplast > 0 || *keepdays > 0 {
+		if err := pruneBackups(log.Default(), bundleDistro, *keeplast, *keepdays, false); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+}
+
+// sidecars returns the files written alongside the backup file fn, such as its checksum and manifest.
+func sidecars(fn string) []string {
+	entries, err := os.ReadDir(filepath.Dir(fn))
+	if err != nil {
+		return nil
+	}
+
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), filepath.Base(fn)+".") {
+			files = append(files, filepath.Join(filepath.Dir(fn), e.Name()))
+		}
+	}
+
+	return files
+}
+
+// holdLog holds back the log with -quiet-on-skip until it is known whether anything is backed up.
+func holdLog() {
+	if *quietskp {
+		heldLog = &heldWriter{w: log.Writer()}
+		log.SetOutput(heldLog)
+	}
+}
+
+// releaseLog writes out the log held by holdLog, unless every one of results was skipped, in which
+// case a single line says so instead.
+func releaseLog(results []result) {
+	if heldLog == nil {
+		return
+	}
+	defer log.SetOutput(heldLog.w)
+
+	skipped := len(results) > 0
+	for _, r := range results {
+		skipped = skipped && r.skipped()
+	}
+	if !skipped || !heldLog.discard() {
+		heldLog.release()
+		return
+	}
+
+	log.SetOutput(heldLog.w)
+	log.Printf("Nothing backed up, %d of %d distributions skipped: %v\n", len(results), len(results), results[0].err)
+}
+
+// skipped returns true if the backup was deliberately not made rather than failing.
+func (r result) skipped() bool {
+	return errors.Is(r.err, errSkipped) || *skiprun && errors.Is(r.err, errRunning)
+}
+
+// exitCode returns the exit code for a run with results. A run failing only the -min-size check, or
+// only because distributions were running, gets its own code. Skipped distributions don't count, with
+// -fail-fast the failure that stopped the run does.
+func exitCode(results []result) int {
+	code := 0
+	for _, r := range results {
+		c := 1
+		switch {
+		case r.err == nil, r.skipped():
+			continue
+		case errors.Is(r.err, errTooSmall):
+			c = exitTooSmall
+		case errors.Is(r.err, errRunning):
+			c = exitRunning
+		case errors.Is(r.err, errTimedOut):
+			c = exitTimedOut
+		}
+
+		if code != 0 && code != c {
+			c = 1
+		}
+		code = c
+	}
+
+	return code
+}
+
+func main() {
+	flag.Parse()
+	log.SetPrefix(runID + " ")
+	log.SetFlags(log.LstdFlags | log.Lmsgprefix)
+	if err := flagsFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+	initColor()
+
+	// Everything after -- is for wsl --export. Anything else left over is a mistake.
+	if n := flag.NArg(); n > 0 {
+		if os.Args[len(os.Args)-n-1] != "--" {
+			log.Fatalf("Unexpected argument %q, put arguments for wsl --export after --.", flag.Arg(0))
+		}
+		exportArgs = flag.Args()
+	}
+
+	// Let the same command line work for different users and machines.
+	for _, p := range []*string{outfile, outdir, zipdir} {
+		var err error
+		if *p, err = expandPath(*p); err != nil {
+			log.Fatalf("Invalid output path: %v", err)
+		}
+	}
+
+	// Restoring and inspecting need the dictionary too, so load it first.
+	if *zstdict != "" {
+		var err error
+		if *zstdict, err = filepath.Abs(*zstdict); err != nil {
+			log.Fatal(err)
+		}
+		if zstdDict, err = loadZstdDict(*zstdict); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Inspecting a backup is read only and does not need WSL.
+	if *inspect != "" {
+		if err := inspectFile(*inspect); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	switch *encoding {
+	case "utf16le", "utf8", "auto":
+	default:
+		log.Fatalf("Encoding %q not supported. Supported encodings are \"utf16le\" (default), \"utf8\" and \"auto\".", *encoding)
+	}
+
+	if *restore != "" {
+		name := *rname
+		if name == "" {
+			name = *distro
+		}
+
+		if *instdir == "" {
+			log.Fatal("The -install-dir flag is required with -restore.")
+		}
+
+		if err := restoreBackup(*restore, name, *instdir, *replace, *yes); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *listdir != "" {
+		if err := listBackups(*listdir); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *listjson != "" {
+		if err := listBackupsJSON(*listjson); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *zstdtrn != "" {
+		if err := trainZstdDict(backupDir(), *zstdtrn); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *verifman != "" {
+		if err := verifyManifest(*verifman); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *difflive != "" {
+		if err := diffLive(*difflive, *distro); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *forget != "" {
+		if err := forgetDistro(*forget, *yes); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *health || *healthjs {
+		if err := printHealth(checkHealth(), *healthjs); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *termonly {
+		if err := terminateDistro(*distro); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *selftest {
+		if !selfTest() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Validate outfmt format.
+	switch *outfmt {
+	case "vhdx", "tar":
+	case "zip":
+		log.Fatal("To output in zip format, use --z flag. --f flag is to provide the export file format (vhdx or tar).")
+	default:
+		log.Fatalf("Output format %q not supported. Supported formats are \"vhdx\" (default) and \"tar\".", *outfmt)
+	}
+
+	// Validate compression choice.
+	if *outzip != "" && *compact {
+		log.Fatalf("Invalid arguments: Choose --z for ZIP or --c for Compact, but not both.")
+	}
+
+	switch *zipmeth {
+	case "auto", "deflate", "store":
+	default:
+		log.Fatalf("ZIP method %q not supported. Supported methods are \"auto\" (default), \"deflate\" and \"store\".", *zipmeth)
+	}
+
+	// Compression is the only CPU heavy work we do ourselves, so capping the Go scheduler caps it. The
+	// limits are set before -benchmark runs so it measures what a backup under them would do.
+	if *cpus > 0 {
+		runtime.GOMAXPROCS(*cpus)
+		if *gzprocs > *cpus {
+			*gzprocs = *cpus
+		}
+	}
+
+	if *memlimit != "" {
+		limit, err := parseSize(*memlimit)
+		if err != nil {
+			log.Fatalf("Invalid -mem-limit: %v", err)
+		}
+		limitMemory(limit)
+	}
+
+	if *bench != "" {
+		if err := benchmarkFile(*bench); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if zstdDict != nil && *outzip != "zstd" {
+		log.Fatal("The -zstd-dict flag is only valid with -z=zstd.")
+	}
+
+	if *componly != "" {
+		if *outzip == "" && !*compact {
+			log.Fatal("The -compress-only flag needs -z or -c to know how to compress the file.")
+		}
+
+		if err := compressOnly(*componly); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *exclfrom != "" {
+		var err error
+		if excludeGlobs, err = readExcludeFrom(*exclfrom); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if (len(*excludes) > 0 || *exclfrom != "") && *outfmt != "tar" {
+		log.Fatal("The -exclude-path and -exclude-from flags are only valid with tar exports (-f tar).")
+	}
+
+	if len(*paths) > 0 && *outfmt != "tar" {
+		log.Fatal("The -paths flag is only valid with tar exports (-f tar).")
+	}
+
+	for _, p := range *paths {
+		if !strings.HasPrefix(p, "/") || strings.Trim(p, "/") == "" {
+			log.Fatalf("Invalid -paths %q: paths must be absolute and not the root directory.", p)
+		}
+	}
+
+	if *symscan && *outfmt != "tar" {
+		log.Fatal("The -scan-symlinks flag is only valid with tar exports (-f tar).")
+	}
+
+	if *gens < 0 || *gens > 999 {
+		log.Fatal("The -generations flag must be between 1 and 999.")
+	}
+
+	if *all && *outfile != "" {
+		log.Fatal("Invalid arguments: -o cannot be used with -all since every distribution needs its own file.")
+	}
+
+	if *parallel < 1 {
+		log.Fatal("The -parallel flag must be at least 1.")
+	}
+
+	if *dudepth < 1 {
+		log.Fatal("The -du-depth flag must be at least 1.")
+	}
+
+	if *verifcmd != "" {
+		if args, err := splitCommand(*verifcmd); err != nil {
+			log.Fatalf("Invalid -verify-cmd: %v", err)
+		} else if len(args) == 0 {
+			log.Fatal("The -verify-cmd flag needs a command to run.")
+		}
+	}
+
+	if _, ok := checksumAlgos[*sumalgo]; !ok {
+		log.Fatalf("Checksum algorithm %q not supported. Supported algorithms are \"sha256\", \"sha512\" and \"blake3\".", *sumalgo)
+	}
+
+	if *bundle && (!*all || *outzip != "" || *compact || *gens > 0) {
+		log.Fatal("The -bundle flag is only valid with -all, and not with -z, -c or -generations.")
+	}
+
+	if *resticr != "" && (*outfmt != "tar" || *outzip != "" || *compact || *outfile != "" || *bundle) {
+		log.Fatal("The -restic-repo flag needs -f tar, and can't be used with -z, -c, -o or -bundle since no file is written.")
+	}
+
+	if *azdelete && *azure == "" {
+		log.Fatal("The -azure-delete-local flag needs -azure-container.")
+	}
+
+	if len(exportArgs) > 0 && distroTar() {
+		log.Fatal("Arguments after -- are passed to wsl --export, which isn't used with -exclude-path, -exclude-from or -paths.")
+	}
+
+	if (*match != "" || *nomatch != "") && !*all {
+		log.Fatal("The -match and -exclude-match flags choose distributions for -all.")
+	}
+
+	for _, m := range []struct {
+		flag, expr string
+		re         **regexp.Regexp
+	}{{"match", *match, &matchRE}, {"exclude-match", *nomatch, &noMatchRE}} {
+		if m.expr == "" {
+			continue
+		}
+
+		var err error
+		if *m.re, err = regexp.Compile(m.expr); err != nil {
+			log.Fatalf("Invalid -%s: %v", m.flag, err)
+		}
+	}
+
+	if *level < 0 || *level > 11 {
+		log.Fatal("The -level flag must be from 0 to 11.")
+	}
+
+	if *summary && *progress == "-" {
+		log.Fatal("The -summary-json flag cannot be used with -progress-file - since both write to stdout.")
+	}
+
+	if *stdhdr && !*tostdout {
+		log.Fatal("The -stdout-header flag needs -stdout.")
+	}
+
+	if *runas != "" && len(*stopsvcs) == 0 && len(*startsvc) == 0 {
+		log.Fatal("The -run-as-user flag needs -stop-services or -start-services.")
+	}
+
+	if *vhdpath != "" {
+		if *all {
+			log.Fatal("The -vhd-path flag is the disk of one -distro and can't be used with -all.")
+		}
+		fi, err := os.Stat(*vhdpath)
+		if err != nil {
+			log.Fatalf("Invalid -vhd-path: %v", err)
+		}
+		if !fi.Mode().IsRegular() {
+			log.Fatalf("The -vhd-path %s is not a file.", *vhdpath)
+		}
+	}
+
+	if *fsfreeze && (*outfmt != "vhdx" || distroTar() || *resticr != "") {
+		log.Fatal("The -fsfreeze flag needs -f vhdx and cannot be used with -exclude-path, -exclude-from, -paths or -restic-repo.")
+	}
+
+	if *onepass && (!*manifest || *outzip == "") {
+		log.Fatal("The -single-pass flag needs -manifest and -z.")
+	}
+
+	if *shareurl && *azure == "" {
+		log.Fatal("The -share-url flag needs -azure-container.")
+	}
+
+	if *shareexp <= 0 {
+		log.Fatal("The -share-expiry flag must be positive.")
+	}
+
+	switch *shareqr {
+	case "":
+	case "terminal", "png":
+		if !*shareurl {
+			log.Fatal("The -share-qr flag needs -share-url.")
+		}
+	default:
+		log.Fatalf("Invalid -share-qr %q, expected \"terminal\" or \"png\".", *shareqr)
+	}
+
+	if *friendly != "" && (*all || fileDistro("") == "") {
+		log.Fatal("The -friendly-name flag needs a name with letters or numbers in it, and can't be used with -all.")
+	}
+
+	if *failfast && !*all {
+		log.Fatal("The -fail-fast flag is only valid with -all.")
+	}
+
+	if *gens > 0 && *outfile != "" {
+		log.Fatal("Invalid arguments: Choose -o for a fixed filename or -generations for rolling names, but not both.")
+	}
+
+	if *chkmount {
+		dirs := []string{backupDir()}
+		if *outfile != "" {
+			dirs = []string{filepath.Dir(filepath.Join(backupDir(), *outfile))}
+			if filepath.IsAbs(*outfile) {
+				dirs = []string{filepath.Dir(*outfile)}
+			}
+		}
+		if *zipdir != "" {
+			dirs = append(dirs, *zipdir)
+		}
+
+		for _, d := range dirs {
+			if err := checkTarget(d); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	switch *progress {
+	case "":
+	case "-":
+		progressOut = os.Stdout
+	default:
+		f, err := os.Create(*progress)
+		if err != nil {
+			log.Fatal(err)
 		}
+		defer f.Close()
+		progressOut = f
+	}
+
+	// Validate minimum size.
+	if *minsize != "" {
+		var err error
+		if minBytes, err = parseSize(*minsize); err != nil {
+			log.Fatalf("Invalid -min-size: %v", err)
+		}
+	}
+
+	if *maxsize != "" {
+		var err error
+		if maxBytes, err = parseSize(*maxsize); err != nil {
+			log.Fatalf("Invalid -max-size: %v", err)
+		}
+	}
+
+	if *cthresh != "" {
+		var err error
+		if compressMin, err = parseSize(*cthresh); err != nil {
+			log.Fatalf("Invalid -compress-threshold: %v", err)
+		}
+	}
+
+	if *chkupd {
+		updateCheck()
+	}
+
+	if *minwsl != "" {
+		if !regexp.MustCompile(`^\d+(\.\d+)*$`).MatchString(*minwsl) {
+			log.Fatalf("Invalid -min-wsl-version %q, expected a version like 2.0.14.", *minwsl)
+		}
+
+		v, err := wslVersion()
+		if err != nil {
+			log.Fatalf("Could not determine the WSL version to check -min-wsl-version: %v", err)
+		}
+
+		if compareVersions(v, *minwsl) < 0 {
+			log.Fatalf("WSL %s is older than the required -min-wsl-version %s, run \"%s --update\".", v, *minwsl, wsl)
+		}
+	}
+
+	if *prunepre {
+		if *keeplast < 1 && *keepdays < 1 {
+			log.Fatal("The -prune-preview flag needs -keep-last or -keep-days to know which backups to keep.")
+		}
+
+		if err := previewPrune(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *maxrun > 0 {
+		runCtx, cancelRun = context.WithTimeout(context.Background(), *maxrun)
+		go func() {
+			<-runCtx.Done()
+			if runCtx.Err() != context.DeadlineExceeded {
+				return
+			}
+			phases.Range(func(distro, phase interface{}) bool {
+				log.Printf("The -max-runtime of %v ran out in the %s stage of the %s backup.\n", *maxrun, phase, distro)
+				return true
+			})
+		}()
+	}
+
+	if *cancelf != "" {
+		if _, err := os.Stat(*cancelf); err == nil {
+			log.Fatalf("The -cancel-file %s already exists, remove it to run a backup.", *cancelf)
+		}
+		go watchCancel(*cancelf)
+	}
+
+	if *tostdout {
+		if *all {
+			log.Fatal("The -stdout flag streams -distro and can't be used with -all.")
+		}
+		if *summary || *progress == "-" {
+			log.Fatal("The -stdout flag cannot be used with -summary-json or -progress-file - since they also write to stdout.")
+		}
+		if *outfmt != "tar" {
+			log.Fatal("The -stdout flag streams a tar export, vhdx files can't be streamed. Use -f tar.")
+		}
+
+		if err := streamExport(*distro, *sumfile); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *measure {
+		if *all {
+			log.Fatal("The -measure flag measures -distro and can't be used with -all.")
+		}
+
+		if err := measureExport(*distro); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Shutting WSL down and terminating distributions can change the default, note it to put it back.
+	var defDistro string
+	if *refdef {
+		var err error
+		if defDistro, err = defaultDistro(); err != nil {
+			log.Printf("Warning: could not find the default distribution for -refresh-default: %v", err)
+		}
+	}
 
-		if !*keep {
-			// Delete the original file.
-			os.Remove(of)
+	var results []result
+	if *all {
+		results = backupAll()
+	} else {
+		// Without -distro, let an interactive user pick one if the default isn't installed.
+		if !flagSet("distro") && interactive() && !*summary {
+			if ok, err := distroCheck(log.Default(), *distro); !ok && err == nil {
+				if *distro, err = chooseDistro(); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+
+		holdLog()
+		res := backup(log.Default(), *distro)
+		if res.skipped() {
+			log.Printf("Skipping backup: %v", res.err)
+		} else if res.err != nil {
+			log.Print(red(fmt.Sprintf("Error: %v", res.err)))
+		}
+		results = append(results, res)
+	}
+	releaseLog(results)
+
+	if defDistro != "" {
+		if err := restoreDefault(defDistro); err != nil {
+			log.Printf("Warning: error restoring the default distribution: %v", err)
+		}
+	}
+
+	if *statusf != "" {
+		if err := writeStatus(*statusf, results); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	if *metricsf != "" {
+		if err := writeMetrics(*metricsf, results); err != nil {
+			log.Printf("Warning: error writing metrics: %v", err)
 		}
+	}
 
-		os.Exit(0)
+	if *report != "" {
+		if err := writeReport(*report, backupDir(), results); err != nil {
+			log.Printf("Warning: error writing HTML report: %v", err)
+		}
 	}
 
-	if *compact {
-		if err := compactFile(of); err != nil {
-			log.Fatalf("Error compacting file: %v", err)
+	if *summary {
+		if err := printSummary(results); err != nil {
+			log.Printf("Warning: error writing JSON summary: %v", err)
 		}
 	}
+
+	os.Exit(exitCode(results))
 }
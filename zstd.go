@@ -0,0 +1,190 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// zstdDictSize is the size of dictionaries made by -zstd-train, the same as the zstd tool's default.
+	zstdDictSize = 110 << 10
+	// zstdSampleMax is the largest file inside a backup used as a sample. Bigger files compress well
+	// without a dictionary.
+	zstdSampleMax = 128 << 10
+	// zstdTrainMax is how much sample data -zstd-train reads in total, spread over the backups.
+	zstdTrainMax = 64 << 20
+)
+
+// zstdDict is the dictionary loaded from -zstd-dict, if any.
+var zstdDict []byte
+
+// loadZstdDict reads the zstd dictionary fn.
+func loadZstdDict(fn string) ([]byte, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("error reading zstd dictionary: %v", err)
+	}
+
+	if _, err := zstd.InspectDictionary(b); err != nil {
+		return nil, fmt.Errorf("%s is not a zstd dictionary: %v", fn, err)
+	}
+
+	return b, nil
+}
+
+// zstdDictID returns the ID of the zstd dictionary b.
+func zstdDictID(b []byte) uint32 {
+	d, err := zstd.InspectDictionary(b)
+	if err != nil {
+		return 0
+	}
+
+	return d.ID()
+}
+
+// newZstdWriter compresses with zstd on every core allowed by -cpus, or as many as fit in -mem-limit,
+// using the -zstd-dict dictionary if there is one. The zstd frame format has nowhere to store name.
+func newZstdWriter(w io.Writer, name string) (io.WriteCloser, error) {
+	opts := []zstd.EOption{zstd.WithEncoderConcurrency(runtime.GOMAXPROCS(0))}
+	if zstdWindow > 0 {
+		opts = []zstd.EOption{zstd.WithEncoderConcurrency(zstdConc), zstd.WithWindowSize(zstdWindow), zstd.WithLowerEncoderMem(true)}
+	}
+	if zstdDict != nil {
+		opts = append(opts, zstd.WithEncoderDict(zstdDict))
+	}
+
+	return zstd.NewWriter(w, opts...)
+}
+
+// backupZstdDict returns the dictionary the zstd backup fn was compressed with: -zstd-dict if given,
+// otherwise the one recorded in its manifest. It returns nil if neither is known, which is fine for
+// backups compressed without a dictionary.
+func backupZstdDict(fn string) ([]byte, error) {
+	if zstdDict != nil {
+		return zstdDict, nil
+	}
+
+	m, err := readManifest(fn)
+	if err != nil || m.ZstdDict == "" {
+		return nil, nil
+	}
+
+	return loadZstdDict(m.ZstdDict)
+}
+
+// openZstd opens the zstd compressed file fn.
+func openZstd(fn string) (io.ReadCloser, error) {
+	d, err := backupZstdDict(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []zstd.DOption
+	if d != nil {
+		opts = append(opts, zstd.WithDecoderDicts(d))
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := zstd.NewReader(f, opts...)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error opening zstd file: %v", err)
+	}
+
+	rc := zr.IOReadCloser()
+	return &multiCloser{rc, []io.Closer{rc, f}}, nil
+}
+
+// trainZstdDict builds a zstd dictionary from the files inside the tar backups in dir and writes it
+// to dst. Configuration files, scripts and the like barely change between backups of similar
+// distributions, so they make good samples.
+func trainZstdDict(dir, dst string) error {
+	list, err := scanBackups(dir)
+	if err != nil {
+		return err
+	}
+
+	var tars []string
+	for _, b := range list {
+		if b.name.format == "tar" {
+			tars = append(tars, b.path)
+		}
+	}
+
+	if len(tars) == 0 {
+		return fmt.Errorf("no tar backups found in %s to train a zstd dictionary from", dir)
+	}
+
+	var samples [][]byte
+	for _, fn := range tars {
+		s, err := zstdSamples(fn, zstdTrainMax/len(tars))
+		if err != nil {
+			return fmt.Errorf("error reading samples from %s: %v", fn, err)
+		}
+		samples = append(samples, s...)
+	}
+
+	log.Printf("Training zstd dictionary from %d files in %d backups...\n", len(samples), len(tars))
+	b, err := dict.BuildZstdDict(samples, dict.Options{MaxDictSize: zstdDictSize, HashBytes: 6})
+	if err != nil {
+		return fmt.Errorf("error training zstd dictionary: %v", err)
+	}
+
+	if err := writeAtomic(dst, b); err != nil {
+		return err
+	}
+	log.Printf("zstd dictionary with ID %d written to %s.\n", zstdDictID(b), dst)
+
+	return nil
+}
+
+// zstdSamples returns the contents of small regular files in the tar backup fn, up to limit bytes.
+func zstdSamples(fn string, limit int) ([][]byte, error) {
+	var rc io.ReadCloser
+	var err error
+	if uncompressedName(fn) != fn {
+		rc, _, err = openCompressed(fn)
+	} else {
+		rc, err = os.Open(fn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var samples [][]byte
+	tr := tar.NewReader(rc)
+	for total := 0; total < limit; {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 || hdr.Size > zstdSampleMax {
+			continue
+		}
+
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, b)
+		total += len(b)
+	}
+
+	return samples, nil
+}